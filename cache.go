@@ -2,10 +2,16 @@ package disgordtlru
 
 import (
 	"container/list"
+	"errors"
+	"fmt"
 	"github.com/andersfylling/disgord"
 	"github.com/andersfylling/disgord/json"
-	"github.com/auttaja/go-tlru"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,458 +31,2876 @@ type idHolder struct {
 	ChannelID disgord.Snowflake `json:"channel_id"`
 }
 
+// The Discord epoch (the first second of 2015) in milliseconds.
+const discordEpoch = 1420070400000
+
+// Used to get the time a snowflake was generated at using the Discord epoch.
+func snowflakeTime(id disgord.Snowflake) time.Time {
+	ms := int64(uint64(id)>>22) + discordEpoch
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
+
+// Defines the key used for voice states in the cache.
+type voiceStateKey struct {
+	GuildID disgord.Snowflake
+	UserID  disgord.Snowflake
+}
+
+// Defines the key used for messages in the cache.
+type messageKey struct {
+	ChannelID disgord.Snowflake
+	MessageID disgord.Snowflake
+}
+
 // A wrapper of the TLRU cache with a mutex built in for ease of use.
 // Note that whilst the TLRU already has a mutex built in, this is to stop internal purge race conditions rather than codebase ones like we want to solve here.
 type tlruWrapper struct {
-	*tlru.Cache
+	*tlruCache
 	sync.Mutex
 }
 
-// Defines the cache.
-type cache struct {
-	disgord.CacheNop
-
-	ReturnGetGuildMembers bool
+// A TLRU cache with its locking split into shards by key.
+// Items in different shards can be worked on in parallel, whilst Lock and Unlock hold every shard for bulk operations.
+type shardedTLRU struct {
+	*tlruCache
+	shards []sync.Mutex
+}
 
-	CurrentUserMu sync.Mutex
-	CurrentUser   *disgord.User
+func newShardedTLRU(cache *tlruCache, shards int) *shardedTLRU {
+	if shards < 1 {
+		shards = 1
+	}
+	return &shardedTLRU{tlruCache: cache, shards: make([]sync.Mutex, shards)}
+}
 
-	ChannelMu                sync.RWMutex
-	Channels                 map[disgord.Snowflake]*disgord.Channel
-	GuildChannelRelationship map[disgord.Snowflake]*list.List
+// LockKey is used to lock the shard which the key belongs to.
+func (s *shardedTLRU) LockKey(key disgord.Snowflake) {
+	s.shards[uint64(key)%uint64(len(s.shards))].Lock()
+}
 
-	Users       *tlruWrapper
-	VoiceStates *tlruWrapper
-	Guilds      *tlruWrapper
+// UnlockKey is used to unlock the shard which the key belongs to.
+func (s *shardedTLRU) UnlockKey(key disgord.Snowflake) {
+	s.shards[uint64(key)%uint64(len(s.shards))].Unlock()
 }
 
-func (c *cache) registerChannelRelationship(guildId, channelId disgord.Snowflake) {
-	if guildId == 0 {
-		return
+// Lock is used to lock every shard. The shards are always locked in order to avoid deadlocks.
+// This MUST NOT be called whilst holding a single shard.
+func (s *shardedTLRU) Lock() {
+	for i := range s.shards {
+		s.shards[i].Lock()
 	}
-	relationships, ok := c.GuildChannelRelationship[guildId]
-	if !ok {
-		relationships = list.New()
-		c.GuildChannelRelationship[guildId] = relationships
-	}
-	relationships.PushBack(channelId)
 }
 
-func (c *cache) destroyChannelRelationship(guildId, channelId disgord.Snowflake) {
-	if guildId == 0 {
-		return
-	}
-	relationships, ok := c.GuildChannelRelationship[guildId]
-	if !ok {
-		return
-	}
-	blank := true
-	for x := relationships.Front(); x != nil; x = x.Next() {
-		if x.Value.(disgord.Snowflake) == channelId {
-			relationships.Remove(x)
-			break
-		}
-		blank = false
-	}
-	if blank {
-		delete(c.GuildChannelRelationship, guildId)
+// Unlock is used to unlock every shard.
+func (s *shardedTLRU) Unlock() {
+	for i := range s.shards {
+		s.shards[i].Unlock()
 	}
 }
 
-func (c *cache) Ready(data []byte) (*disgord.Ready, error) {
-	c.CurrentUserMu.Lock()
-	defer c.CurrentUserMu.Unlock()
+// Defines a guild as it is stored in the guild TLRU.
+// Members are indexed by user ID so that member events and lookups do not need to scan the member list.
+type cachedGuild struct {
+	Guild *disgord.Guild
 
-	rdy := &disgord.Ready{
-		User: c.CurrentUser,
-	}
+	// Maps a user ID to the index of the member within Guild.Members.
+	MemberIndex map[disgord.Snowflake]int
+}
 
-	err := json.Unmarshal(data, rdy)
-	return rdy, err
+// Used to create a cached guild, indexing the members.
+func newCachedGuild(guild *disgord.Guild) *cachedGuild {
+	g := &cachedGuild{Guild: guild}
+	g.indexMembers()
+	return g
 }
 
-func (c *cache) ChannelCreate(data []byte) (*disgord.ChannelCreate, error) {
-	wrap := func(c *disgord.Channel) *disgord.ChannelCreate {
-		return &disgord.ChannelCreate{Channel: c}
+// Used to rebuild the member index from the member list. Any nil members are dropped.
+func (g *cachedGuild) indexMembers() {
+	members := g.Guild.Members[:0]
+	g.MemberIndex = make(map[disgord.Snowflake]int, len(g.Guild.Members))
+	for _, member := range g.Guild.Members {
+		if member == nil {
+			continue
+		}
+		if member.UserID.IsZero() && member.User != nil {
+			// disgord only fills this in when the event is patched, which is not the case for members decoded in place.
+			member.UserID = member.User.ID
+		}
+		if i, ok := g.MemberIndex[member.UserID]; ok {
+			// Keep the latest copy of a duplicated member.
+			members[i] = member
+			continue
+		}
+		g.MemberIndex[member.UserID] = len(members)
+		members = append(members, member)
 	}
-
-	var channel *disgord.Channel
-	if err := json.Unmarshal(data, &channel); err != nil {
-		return nil, err
+	for i := len(members); i < len(g.Guild.Members); i++ {
+		g.Guild.Members[i] = nil
 	}
+	g.Guild.Members = members
+	g.countLoadedMembers()
+}
 
-	c.ChannelMu.Lock()
-	defer c.ChannelMu.Unlock()
-	if wrapper, exists := c.Channels[channel.ID]; exists {
-		err := json.Unmarshal(data, wrapper)
-		return wrap(channel), err
+// Used to raise the member count to the amount of loaded members if it is behind, such as when member_count was not sent.
+// Loaded members always belong to the guild, so the count can't be lower than them.
+func (g *cachedGuild) countLoadedMembers() {
+	if loaded := uint(len(g.Guild.Members)); g.Guild.MemberCount < loaded {
+		g.Guild.MemberCount = loaded
 	}
+}
 
-	c.Channels[channel.ID] = channel
-	c.registerChannelRelationship(channel.GuildID, channel.ID)
+// Used to find a loaded member. Returns nil if the member is not loaded.
+func (g *cachedGuild) member(userID disgord.Snowflake) *disgord.Member {
+	i, ok := g.MemberIndex[userID]
+	if !ok {
+		return nil
+	}
+	return g.Guild.Members[i]
+}
 
-	return wrap(channel), nil
+// Used to add a member which is not already loaded.
+func (g *cachedGuild) addMember(member *disgord.Member) {
+	g.MemberIndex[member.UserID] = len(g.Guild.Members)
+	g.Guild.Members = append(g.Guild.Members, member)
 }
 
-func (c *cache) ChannelUpdate(data []byte) (*disgord.ChannelUpdate, error) {
-	var metadata *idHolder
-	if err := json.Unmarshal(data, &metadata); err != nil {
-		return nil, err
+// Used to remove a loaded member. Returns false if the member was not loaded.
+func (g *cachedGuild) removeMember(userID disgord.Snowflake) bool {
+	i, ok := g.MemberIndex[userID]
+	if !ok {
+		return false
 	}
-	channelID := metadata.ID
-
-	c.ChannelMu.Lock()
-	defer c.ChannelMu.Unlock()
+	last := len(g.Guild.Members) - 1
+	moved := g.Guild.Members[last]
+	g.Guild.Members[i] = moved
+	g.MemberIndex[moved.UserID] = i
+	g.Guild.Members[last] = nil
+	g.Guild.Members = g.Guild.Members[:last]
+	delete(g.MemberIndex, userID)
+	return true
+}
 
-	var channel *disgord.Channel
-	var exists bool
-	if channel, exists = c.Channels[channelID]; exists {
-		if err := json.Unmarshal(data, channel); err != nil {
-			return nil, err
-		}
-	} else {
-		if err := json.Unmarshal(data, &channel); err != nil {
-			return nil, err
+// Used to check the member count and member index for inconsistencies.
+func (g *cachedGuild) validate() []error {
+	var errs []error
+	guild := g.Guild
+	if int(guild.MemberCount) < len(guild.Members) {
+		errs = append(errs, fmt.Errorf("disgordtlru: guild %s has a member count of %d but %d members loaded", guild.ID, guild.MemberCount, len(guild.Members)))
+	}
+	if len(g.MemberIndex) != len(guild.Members) {
+		errs = append(errs, fmt.Errorf("disgordtlru: guild %s has %d members but %d indexed, it may contain duplicates", guild.ID, len(guild.Members), len(g.MemberIndex)))
+	}
+	for userId, i := range g.MemberIndex {
+		if i < 0 || i >= len(guild.Members) || guild.Members[i] == nil || guild.Members[i].UserID != userId {
+			errs = append(errs, fmt.Errorf("disgordtlru: guild %s indexes member %s at %d which does not hold it", guild.ID, userId, i))
 		}
-		c.Channels[channelID] = channel
-		c.registerChannelRelationship(channel.GuildID, channel.ID)
 	}
-
-	return &disgord.ChannelUpdate{Channel: channel}, nil
+	return errs
 }
 
-func (c *cache) ChannelDelete(data []byte) (*disgord.ChannelDelete, error) {
-	var cd *disgord.ChannelDelete
-	if err := json.Unmarshal(data, &cd); err != nil {
-		return nil, err
-	}
+// MetricsHook is used to observe cache operations, such as to feed them into a metrics backend.
+// The cache type is one of "guild", "channel", "user", "voice_state" or "message".
+// The hook is called with cache locks held, so it must be quick and must not call back into the cache.
+type MetricsHook interface {
+	// ObserveGet is called whenever the cache looks up an item.
+	ObserveGet(cacheType string, hit bool)
 
-	c.ChannelMu.Lock()
-	defer c.ChannelMu.Unlock()
-	delete(c.Channels, cd.Channel.ID)
-	c.destroyChannelRelationship(cd.Channel.GuildID, cd.Channel.ID)
+	// ObserveSet is called whenever the cache stores an item.
+	ObserveSet(cacheType string)
+}
 
-	return cd, nil
+// CacheReader is used to define the read only view of the cache given to post handlers.
+type CacheReader interface {
+	GetChannel(id disgord.Snowflake) (*disgord.Channel, error)
+	GetGuild(id disgord.Snowflake) (*disgord.Guild, error)
+	GetGuildChannels(id disgord.Snowflake) ([]*disgord.Channel, error)
+	GetGuildRoles(guildID disgord.Snowflake) ([]*disgord.Role, error)
+	GetGuildEmojis(id disgord.Snowflake) ([]*disgord.Emoji, error)
+	GetMember(guildID, userID disgord.Snowflake) (*disgord.Member, error)
+	GetCurrentUser() (*disgord.User, error)
+	GetUser(id disgord.Snowflake) (*disgord.User, error)
+	GetVoiceState(guildID, userID disgord.Snowflake) (*disgord.VoiceState, error)
+	GetMessage(channelID, messageID disgord.Snowflake) (*disgord.Message, error)
 }
 
-func (c *cache) ChannelPinsUpdate(data []byte) (*disgord.ChannelPinsUpdate, error) {
-	var cpu *disgord.ChannelPinsUpdate
-	if err := json.Unmarshal(data, &cpu); err != nil {
-		return nil, err
-	}
+// Cache is used to define the cache returned by NewCache. This is a disgord.Cache along with everything this cache adds on top.
+// disgord only knows about the disgord.Cache methods, so keep hold of what NewCache returns to use the others.
+type Cache interface {
+	disgord.Cache
+	CacheReader
+
+	// Handler hooks
+	RegisterPostHandler(event string, fn func(cache CacheReader, data []byte))
+
+	// Channels
+	GetAllChannels() ([]*disgord.Channel, error)
+	SetChannels(guildID disgord.Snowflake, channels []*disgord.Channel)
+	SetChannel(channel *disgord.Channel)
+	GetChannelParent(channelID disgord.Snowflake) (*disgord.Channel, error)
+	GetChannelSlowmode(channelID disgord.Snowflake) (int, bool)
+	GetChannelOverwriteFor(channelID, targetID disgord.Snowflake) (*disgord.PermissionOverwrite, error)
+	IsChannelNSFW(channelID disgord.Snowflake) (bool, bool)
+	GetChannelRecipients(channelID disgord.Snowflake) ([]*disgord.User, error)
+	GetDMChannelForUser(userID disgord.Snowflake) (*disgord.Channel, error)
+	GetGuildChannelByName(guildID disgord.Snowflake, name string) (*disgord.Channel, error)
+	GetGuildChannelTree(guildID disgord.Snowflake) ([]*ChannelNode, error)
+	GetGuildChannelPositions(guildID disgord.Snowflake) (map[disgord.Snowflake]int, error)
+
+	// Guilds
+	EvictGuilds(ids []disgord.Snowflake)
+	GetGuildEmojisOk(id disgord.Snowflake) ([]*disgord.Emoji, bool)
+	GetGuilds(ids []disgord.Snowflake) (map[disgord.Snowflake]*disgord.Guild, error)
+	GetAllGuilds() ([]*disgord.Guild, error)
+	GetGuildsByFeature(feature string) ([]*disgord.Guild, error)
+	ViewGuild(guildID disgord.Snowflake, fn func(*disgord.Guild) error) error
+	GetGuildWidget(guildID disgord.Snowflake) (enabled bool, channelID disgord.Snowflake, ok bool)
+	GetVoiceServer(guildID disgord.Snowflake) (*disgord.VoiceServerUpdate, bool)
+	GetGuildCreatedAt(guildID disgord.Snowflake) (time.Time, bool)
+	GetGuildBotJoinedAt(guildID disgord.Snowflake) (time.Time, bool)
+	GuildLastEventTime(guildID disgord.Snowflake) (time.Time, bool)
+	GuildFreshness(guildID disgord.Snowflake) (time.Duration, bool)
+
+	// Members and roles
+	GetMemberJoinedAt(guildID, userID disgord.Snowflake) (time.Time, bool)
+	GetMembersPaginated(guildID, after disgord.Snowflake, limit int) ([]*disgord.Member, error)
+	ForEachMember(guildID disgord.Snowflake, fn func(*disgord.Member) bool) error
+	GetGuildMemberIDs(guildID disgord.Snowflake) ([]disgord.Snowflake, error)
+	CountMembers(guildID disgord.Snowflake, pred func(*disgord.Member) bool) (int, error)
+	GetGuildRole(guildID, roleID disgord.Snowflake) (*disgord.Role, error)
+	GetGuildRolesSorted(guildID disgord.Snowflake) ([]*disgord.Role, error)
+	GetMemberRoles(guildID, userID disgord.Snowflake) ([]*disgord.Role, error)
+	GetGuildRoleByPosition(guildID disgord.Snowflake, position int) (*disgord.Role, error)
+	GetMemberHighestRole(guildID, userID disgord.Snowflake) (*disgord.Role, error)
+
+	// Users
+	GetUserFlags(userID disgord.Snowflake) (disgord.UserFlag, bool)
+	UserIDs() []disgord.Snowflake
+	ResetCurrentUser()
+
+	// Voice states
+	GetVoiceChannelUserIDs(guildID, channelID disgord.Snowflake) ([]disgord.Snowflake, error)
+	GetGuildVoiceStates(guildID disgord.Snowflake) ([]*disgord.VoiceState, error)
+	VoiceStateCount() int
+	GuildVoiceStateCount(guildID disgord.Snowflake) (int, bool)
+
+	// Messages
+	GetChannelMessages(channelID disgord.Snowflake, limit int) ([]*disgord.Message, error)
+
+	// Maintenance
+	ValidateRelationships() []error
+	SelfCheck() error
+	Healthy() bool
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+	Clear()
+	FlushGuilds()
+	FlushChannels()
+	FlushUsers()
+	FlushVoiceStates()
+	FlushMessages()
+	Stats() CacheStats
+}
 
-	if cpu.LastPinTimestamp.IsZero() {
-		return cpu, nil
-	}
+var _ Cache = (*cache)(nil)
 
-	c.ChannelMu.Lock()
-	defer c.ChannelMu.Unlock()
-	if channel, exists := c.Channels[cpu.ChannelID]; exists {
-		channel.LastPinTimestamp = cpu.LastPinTimestamp
-	}
+// Defines the cache types passed to the metrics hook.
+const (
+	storeGuild      = "guild"
+	storeChannel    = "channel"
+	storeUser       = "user"
+	storeVoiceState = "voice_state"
+	storeMessage    = "message"
+)
 
-	return cpu, nil
+// CacheStats is used to define the hit and miss counts and item counts of each store.
+// These count every lookup, including the ones event handlers make.
+type CacheStats struct {
+	GuildHits        uint64
+	GuildMisses      uint64
+	ChannelHits      uint64
+	ChannelMisses    uint64
+	UserHits         uint64
+	UserMisses       uint64
+	VoiceStateHits   uint64
+	VoiceStateMisses uint64
+	MessageHits      uint64
+	MessageMisses    uint64
+
+	// The amount of items in each store which have not expired. MessageItems is zero when message caching is off.
+	GuildItems      int
+	ChannelItems    int
+	UserItems       int
+	VoiceStateItems int
+	MessageItems    int
 }
 
-func (c *cache) UserUpdate(data []byte) (*disgord.UserUpdate, error) {
-	update := &disgord.UserUpdate{User: c.CurrentUser}
-
-	c.CurrentUserMu.Lock()
-	defer c.CurrentUserMu.Unlock()
-	if err := json.Unmarshal(data, update); err != nil {
-		return nil, err
-	}
+// Defines the counters behind CacheStats. These are only accessed atomically.
+// This is allocated on its own so the counters are 64-bit aligned on 32-bit platforms.
+type cacheCounters struct {
+	stats CacheStats
 
-	return update, nil
+	// The amount of evictions so far, used to sample the eviction logs.
+	evictions uint64
 }
 
-func (c *cache) VoiceServerUpdate(data []byte) (*disgord.VoiceServerUpdate, error) {
-	var vsu *disgord.VoiceServerUpdate
-	if err := json.Unmarshal(data, &vsu); err != nil {
-		return nil, err
+// Used to count a lookup against a store.
+func (c *cacheCounters) count(cacheType string, hit bool) {
+	var hits, misses *uint64
+	switch cacheType {
+	case storeGuild:
+		hits, misses = &c.stats.GuildHits, &c.stats.GuildMisses
+	case storeChannel:
+		hits, misses = &c.stats.ChannelHits, &c.stats.ChannelMisses
+	case storeUser:
+		hits, misses = &c.stats.UserHits, &c.stats.UserMisses
+	case storeVoiceState:
+		hits, misses = &c.stats.VoiceStateHits, &c.stats.VoiceStateMisses
+	case storeMessage:
+		hits, misses = &c.stats.MessageHits, &c.stats.MessageMisses
+	default:
+		return
+	}
+	if hit {
+		atomic.AddUint64(hits, 1)
+	} else {
+		atomic.AddUint64(misses, 1)
 	}
-
-	return vsu, nil
 }
 
-func (c *cache) GuildMemberRemove(data []byte) (*disgord.GuildMemberRemove, error) {
-	var gmr *disgord.GuildMemberRemove
-	if err := json.Unmarshal(data, &gmr); err != nil {
-		return nil, err
-	}
+// Defines the cache.
+type cache struct {
+	disgord.CacheNop
 
-	c.Guilds.Lock()
-	defer c.Guilds.Unlock()
+	ReturnGetGuildMembers  bool
+	RecoverHandlers        bool
+	DebugConsistencyChecks bool
+	Logger                 disgord.Logger
+	EvictionLogSampleRate  int
+	OnRolesChanged         func(guildID disgord.Snowflake)
+	OnEmojisChanged        func(guildID disgord.Snowflake)
+	OnGuildEvicted         func(guildID disgord.Snowflake, guild *disgord.Guild)
+	OnUserEvicted          func(userID disgord.Snowflake, user *disgord.User)
+	OnVoiceStateEvicted    func(state *disgord.VoiceState)
+	Metrics                MetricsHook
+	counters               *cacheCounters
+
+	// The evictions waiting to be reported to the eviction callbacks. EvictionsMu is a leaf lock.
+	EvictionsMu sync.Mutex
+	Evictions   []func()
+
+	PostHandlersMu sync.RWMutex
+	PostHandlers   map[string][]func(cache CacheReader, data []byte)
 
-	if item, exists := c.Guilds.Get(gmr.GuildID); exists {
-		guild := item.(*disgord.Guild)
+	CurrentUserMu sync.Mutex
+	CurrentUser   *disgord.User
 
-		for i := range guild.Members {
-			if guild.Members[i].UserID == gmr.User.ID {
-				guild.MemberCount--
-				guild.Members[i] = guild.Members[len(guild.Members)-1]
-				guild.Members = guild.Members[:len(guild.Members)-1]
-			}
-		}
-	}
+	// Channels are removed from the relationships below when the TLRU evicts them, but expired channels which are yet to be purged
+	// from the TLRU may still be referenced.
+	ChannelMu                sync.RWMutex
+	Channels                 *tlruCache
+	GuildChannelRelationship map[disgord.Snowflake]*list.List
+	DMChannelRelationship    map[disgord.Snowflake]disgord.Snowflake
 
-	return gmr, nil
-}
+	// Only holds cached guilds, and guilds are forgotten when the guild TLRU evicts them.
+	LastEventMu sync.Mutex
+	LastEvent   map[disgord.Snowflake]time.Time
 
-func (c *cache) GuildMemberAdd(data []byte) (*disgord.GuildMemberAdd, error) {
-	var gmr *disgord.GuildMemberAdd
-	if err := json.Unmarshal(data, &gmr); err != nil {
-		return nil, err
-	}
+	StoreVoiceServers bool
+	VoiceServerMu     sync.Mutex
+	VoiceServers      map[disgord.Snowflake]*disgord.VoiceServerUpdate
 
-	userID := gmr.Member.User.ID
-	c.Users.Lock()
-	if _, exists := c.Users.Get(userID); !exists {
-		c.Users.Set(userID, gmr.Member.User)
-	}
-	c.Users.Unlock()
+	Users       *tlruWrapper
+	VoiceStates *tlruWrapper
+	Guilds      *shardedTLRU
 
-	c.Guilds.Lock()
-	defer c.Guilds.Unlock()
+	// Guarded by the VoiceStates lock. Voice states are removed from this when the TLRU evicts them, but expired voice states
+	// which are yet to be purged from the TLRU may still be referenced.
+	// Each user maps to the sequence number of their last update so the oldest can be found.
+	GuildVoiceStateRelationship map[disgord.Snowflake]map[disgord.Snowflake]uint64
+	VoiceStateSeq               uint64
+	MaxVoiceStatesPerGuild      int
 
-	if item, exists := c.Guilds.Get(gmr.Member.GuildID); exists {
-		guild := item.(*disgord.Guild)
+	// This is nil when message caching is off.
+	Messages        *tlruWrapper
+	MessageMaxItems int
 
-		var member *disgord.Member
-		for i := range guild.Members { // slow... map instead?
-			if guild.Members[i].UserID == gmr.Member.User.ID {
-				member = guild.Members[i]
-				if err := json.Unmarshal(data, member); err != nil {
-					return nil, err
-				}
-				break
-			}
-		}
-		if member == nil {
-			member = &disgord.Member{}
-			*member = *gmr.Member
+	// The only channels messages are cached for. This is nil when messages are cached for every channel.
+	MessageChannels map[disgord.Snowflake]struct{}
 
-			guild.Members = append(guild.Members, member)
-			guild.MemberCount++
-		}
-		member.User = nil
-	}
+	// Guarded by the Messages lock. The message ID's of each channel are kept sorted in ascending order, so the oldest come first.
+	// Messages which have expired but are yet to be purged from the TLRU may still be referenced.
+	ChannelMessageRelationship map[disgord.Snowflake][]disgord.Snowflake
 
-	return gmr, nil
+	// Used to get the current time. This is swapped out in tests.
+	now func() time.Time
 }
 
-func (c *cache) GuildCreate(data []byte) (*disgord.GuildCreate, error) {
-	var guildEvt *disgord.GuildCreate
-	if err := json.Unmarshal(data, &guildEvt); err != nil {
-		return nil, err
+// Used to get a guild from the TLRU along with the member index.
+// THIS FUNCTION EXPECTS THE GUILD LOCK TO BE HELD!
+func (c *cache) getCachedGuild(guildId disgord.Snowflake) (*cachedGuild, bool) {
+	item, ok := c.Guilds.Get(guildId)
+	c.observeGet(storeGuild, ok)
+	if !ok {
+		return nil, false
 	}
+	return item.(*cachedGuild), true
+}
 
-	c.Guilds.Lock()
-	defer c.Guilds.Unlock()
-
-	setChannels := func() {
-		c.ChannelMu.Lock()
-		defer c.ChannelMu.Unlock()
-		relationships, ok := c.GuildChannelRelationship[guildEvt.Guild.ID]
-		if ok {
-			// We should remove these.
-			for x := relationships.Front(); x != nil; x = x.Next() {
-				delete(c.Channels, x.Value.(disgord.Snowflake))
-			}
-		}
-		relationships = list.New()
-		c.GuildChannelRelationship[guildEvt.Guild.ID] = relationships
-		for _, channel := range guildEvt.Guild.Channels {
-			relationships.PushBack(channel.ID)
-			c.Channels[channel.ID] = channel.DeepCopy().(*disgord.Channel)
-		}
+// Used to get a guild from the TLRU.
+// THIS FUNCTION EXPECTS THE GUILD LOCK TO BE HELD!
+func (c *cache) getGuild(guildId disgord.Snowflake) (*disgord.Guild, bool) {
+	guild, ok := c.getCachedGuild(guildId)
+	if !ok {
+		return nil, false
 	}
+	return guild.Guild, true
+}
 
-	if item, exists := c.Guilds.Get(guildEvt.Guild.ID); exists {
-		guild := item.(*disgord.Guild)
-		if !guild.Unavailable {
-			if len(guild.Members) > 0 {
-				// seems like an update event came before create
-				// this kinda... isn't good
-				_ = json.Unmarshal(data, item)
-			} else {
-				// duplicate event
-				return guildEvt, nil
-			}
-		} else {
-			c.Guilds.Set(guildEvt.Guild.ID, guildEvt.Guild)
-			setChannels()
-		}
-	} else {
-		c.Guilds.Set(guildEvt.Guild.ID, guildEvt.Guild)
-		setChannels()
+// Used to get a guild from the TLRU without reviving it, such as when enumerating the guilds.
+// THIS FUNCTION EXPECTS THE GUILD LOCK TO BE HELD!
+func (c *cache) peekGuild(guildId disgord.Snowflake) (*disgord.Guild, bool) {
+	item, ok := c.Guilds.Peek(guildId)
+	if !ok {
+		return nil, false
 	}
-
-	return guildEvt, nil
+	return item.(*cachedGuild).Guild, true
 }
 
-func (c *cache) GuildUpdate(data []byte) (*disgord.GuildUpdate, error) {
-	var guildEvt *disgord.GuildUpdate
-	if err := json.Unmarshal(data, &guildEvt); err != nil {
-		return nil, err
-	}
+// Used to store a guild in the TLRU, indexing the members.
+// THIS FUNCTION EXPECTS THE GUILD LOCK TO BE HELD!
+func (c *cache) setGuild(guild *disgord.Guild) {
+	c.Guilds.Set(guild.ID, newCachedGuild(guild))
+	c.observeSet(storeGuild)
+}
 
-	c.Guilds.Lock()
-	defer c.Guilds.Unlock()
+// Used to delete a guild from the TLRU if it is still there.
+// THIS FUNCTION EXPECTS THE GUILD LOCK TO BE HELD!
+func (c *cache) deleteGuild(guildId disgord.Snowflake) {
+	c.Guilds.Delete(guildId)
+}
 
-	if item, exists := c.Guilds.Get(guildEvt.Guild.ID); exists {
-		guild := item.(*disgord.Guild)
-		if guild.Unavailable {
-			c.Guilds.Set(guildEvt.Guild.ID, guildEvt.Guild)
-		} else if err := json.Unmarshal(data, item); err != nil {
-			return nil, err
-		}
-	} else {
-		c.Guilds.Set(guildEvt.Guild.ID, guildEvt.Guild)
+// Used to report a lookup to the statistics and the metrics hook if there is one.
+func (c *cache) observeGet(cacheType string, hit bool) {
+	c.counters.count(cacheType, hit)
+	if c.Metrics != nil {
+		c.Metrics.ObserveGet(cacheType, hit)
 	}
-
-	return guildEvt, nil
 }
 
-func (c *cache) GuildDelete(data []byte) (*disgord.GuildDelete, error) {
-	var guildEvt *disgord.GuildDelete
-	if err := json.Unmarshal(data, &guildEvt); err != nil {
-		return nil, err
+// Used to report a store to the metrics hook if there is one.
+func (c *cache) observeSet(cacheType string) {
+	if c.Metrics != nil {
+		c.Metrics.ObserveSet(cacheType)
 	}
+}
 
-	c.Guilds.Lock()
-	defer c.Guilds.Unlock()
-	c.Guilds.Delete(guildEvt.UnavailableGuild.ID)
-
-	c.ChannelMu.Lock()
-	defer c.ChannelMu.Unlock()
-	relationships, ok := c.GuildChannelRelationship[guildEvt.UnavailableGuild.ID]
-	if ok {
-		for x := relationships.Front(); x != nil; x = x.Next() {
-			delete(c.Channels, x.Value.(disgord.Snowflake))
+// Used to recover from a panic inside of a handler if RecoverHandlers is set.
+// This must be deferred directly by the handler so that recover is able to stop the panic. The event is a pointer to the
+// handler's named event result, which is set to an empty event if it is still nil since disgord uses the event even on errors.
+func (c *cache) recoverHandler(event string, evt interface{}, err *error) {
+	if !c.RecoverHandlers {
+		return
+	}
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("disgordtlru: recovered from panic in %s: %v", event, r)
+		if c.Logger != nil {
+			c.Logger.Error(*err)
+		}
+		if v := reflect.ValueOf(evt).Elem(); v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
 		}
-		delete(c.GuildChannelRelationship, guildEvt.UnavailableGuild.ID)
 	}
-
-	return guildEvt, nil
 }
 
-func (c *cache) GetChannel(id disgord.Snowflake) (*disgord.Channel, error) {
-	c.ChannelMu.RLock()
-	res, ok := c.Channels[id]
-	if !ok {
-		c.ChannelMu.RUnlock()
-		return nil, nil
+// Used to log an eviction from a store through the logger. Only one in every EvictionLogSampleRate evictions is logged so that
+// caches with a lot of churn do not flood the logs.
+func (c *cache) logEviction(cacheType string, key interface{}) {
+	if c.Logger == nil || c.EvictionLogSampleRate <= 0 {
+		return
+	}
+	if (atomic.AddUint64(&c.counters.evictions, 1)-1)%uint64(c.EvictionLogSampleRate) == 0 {
+		c.Logger.Debug(fmt.Sprintf("disgordtlru: evicted %s %v", cacheType, key))
 	}
-	cpy := res.DeepCopy().(*disgord.Channel)
-	c.ChannelMu.RUnlock()
-	return cpy, nil
 }
 
-func (c *cache) GetGuildEmoji(guildID, emojiID disgord.Snowflake) (*disgord.Emoji, error) {
-	c.Guilds.Lock()
-	defer c.Guilds.Unlock()
-	guild, ok := c.Guilds.Get(guildID)
-	if !ok {
-		return nil, nil
-	}
-	for _, emoji := range guild.(*disgord.Guild).Emojis {
-		if emoji.ID == emojiID {
-			return emoji.DeepCopy().(*disgord.Emoji), nil
-		}
+// Used to report a consistency problem found with DebugConsistencyChecks.
+func (c *cache) reportInconsistency(err error) {
+	if c.Logger == nil {
+		panic(err)
 	}
-	return nil, nil
+	c.Logger.Error(err)
 }
 
-func (c *cache) GetGuildEmojis(id disgord.Snowflake) ([]*disgord.Emoji, error) {
-	c.Guilds.Lock()
-	defer c.Guilds.Unlock()
-	guild, ok := c.Guilds.Get(id)
-	if !ok {
-		return nil, nil
+// Used to validate a guild's members after a handler mutates it if DebugConsistencyChecks is set.
+// This must be deferred before the guild lock is taken so that it runs once the lock is released.
+func (c *cache) checkGuildConsistency(guildId disgord.Snowflake) {
+	if !c.DebugConsistencyChecks {
+		return
 	}
-	a := make([]*disgord.Emoji, len(guild.(*disgord.Guild).Emojis))
-	for i, emoji := range guild.(*disgord.Guild).Emojis {
-		a[i] = emoji.DeepCopy().(*disgord.Emoji)
+	for _, err := range c.validateGuild(guildId) {
+		c.reportInconsistency(err)
 	}
-	return a, nil
 }
 
-func (c *cache) GetGuild(id disgord.Snowflake) (*disgord.Guild, error) {
-	// Make a copy of the guild.
-	c.Guilds.Lock()
-	res, ok := c.Guilds.Get(id)
+// Used to validate a cached guild under its lock. Returns nil if the guild is not cached.
+func (c *cache) validateGuild(guildId disgord.Snowflake) []error {
+	c.Guilds.LockKey(guildId)
+	defer c.Guilds.UnlockKey(guildId)
+	entry, ok := c.getCachedGuild(guildId)
 	if !ok {
-		c.Guilds.Unlock()
-		return nil, nil
+		return nil
 	}
-	var membersBefore []*disgord.Member
-	if !c.ReturnGetGuildMembers {
-		g := res.(*disgord.Guild)
-		membersBefore = g.Members
-		g.Members = []*disgord.Member{}
+	return entry.validate()
+}
+
+// Used to validate the channel relationships after a handler mutates them if DebugConsistencyChecks is set.
+// This must be deferred before the channel lock is taken so that it runs once the lock is released.
+func (c *cache) checkChannelConsistency() {
+	if !c.DebugConsistencyChecks {
+		return
 	}
-	cpy := res.(*disgord.Guild).DeepCopy().(*disgord.Guild)
-	if !c.ReturnGetGuildMembers {
-		res.(*disgord.Guild).Members = membersBefore
+	for _, err := range c.ValidateRelationships() {
+		c.reportInconsistency(err)
 	}
-	c.Guilds.Unlock()
+}
 
-	// Get the channels.
-	channelsRes, _ := c.GetGuildChannels(id)
-	if channelsRes != nil {
-		cpy.Channels = channelsRes
-	}
+// RegisterPostHandler is used to run a function after the cache has handled an event, such as disgord.EvtGuildCreate.
+// The function is called once the cache locks are released, so it sees the updated state. It is not called if handling the event failed.
+func (c *cache) RegisterPostHandler(event string, fn func(cache CacheReader, data []byte)) {
+	c.PostHandlersMu.Lock()
+	c.PostHandlers[event] = append(c.PostHandlers[event], fn)
+	c.PostHandlersMu.Unlock()
+}
 
-	// Return the copy.
-	return cpy, nil
+// Used to queue an eviction to be reported by reportEvictions.
+func (c *cache) queueEviction(fn func()) {
+	c.EvictionsMu.Lock()
+	c.Evictions = append(c.Evictions, fn)
+	c.EvictionsMu.Unlock()
 }
 
-func (c *cache) GetGuildChannels(id disgord.Snowflake) ([]*disgord.Channel, error) {
-	c.ChannelMu.RLock()
+// Used to report the queued evictions to the eviction callbacks, in the order the items were evicted.
+// This must be deferred by anything which sets guilds, users or voice states before it takes any locks so that it runs once the
+// locks are released. This leaves the callbacks free to read from the cache.
+func (c *cache) reportEvictions() {
+	c.EvictionsMu.Lock()
+	evictions := c.Evictions
+	c.Evictions = nil
+	c.EvictionsMu.Unlock()
+	for _, fn := range evictions {
+		fn()
+	}
+}
+
+// Used to run the post handlers registered for an event.
+// This must be deferred before recoverHandler so that it runs last.
+func (c *cache) runPostHandlers(event string, data []byte, err *error) {
+	if *err != nil {
+		return
+	}
+	c.PostHandlersMu.RLock()
+	handlers := c.PostHandlers[event]
+	c.PostHandlersMu.RUnlock()
+	for _, fn := range handlers {
+		fn(c, data)
+	}
+}
+
+// Used to mark that a guild scoped event was just received. This is only recorded for cached guilds so that the last event times
+// are bounded by the guild TLRU, which forgets them when it evicts the guild.
+func (c *cache) touchGuild(guildId disgord.Snowflake) {
+	if guildId == 0 {
+		return
+	}
+	// The guild is checked under the last event lock so that it cannot be evicted and forgotten before the time is recorded.
+	c.LastEventMu.Lock()
+	if _, ok := c.Guilds.Peek(guildId); ok {
+		c.LastEvent[guildId] = c.now()
+	}
+	c.LastEventMu.Unlock()
+}
+
+// Used to remove everything cached for a guild. This drops the guild, its channels and their messages, its voice states,
+// and its last event time and voice server.
+// THIS FUNCTION EXPECTS THE GUILD LOCK TO BE HELD!
+func (c *cache) destroyGuild(guildId disgord.Snowflake) {
+	c.deleteGuild(guildId)
+
+	// The locks are released with defers so that a recovered panic does not leave them held.
+	func() {
+		c.ChannelMu.Lock()
+		defer c.ChannelMu.Unlock()
+		c.destroyGuildChannelMessages(guildId)
+		c.destroyGuildChannels(guildId)
+	}()
+
+	func() {
+		c.VoiceStates.Lock()
+		defer c.VoiceStates.Unlock()
+		c.destroyGuildVoiceStates(guildId)
+	}()
+
+	c.forgetGuildEvents(guildId)
+}
+
+// Used to forget the last event time and voice server of a guild which is no longer cached.
+func (c *cache) forgetGuildEvents(guildId disgord.Snowflake) {
+	c.LastEventMu.Lock()
+	delete(c.LastEvent, guildId)
+	c.LastEventMu.Unlock()
+
+	c.VoiceServerMu.Lock()
+	delete(c.VoiceServers, guildId)
+	c.VoiceServerMu.Unlock()
+}
+
+// Used to deep copy a slice of roles, skipping any nil entries.
+func copyRoles(roles []*disgord.Role) []*disgord.Role {
+	cpy := make([]*disgord.Role, 0, len(roles))
+	for _, role := range roles {
+		if role != nil {
+			cpy = append(cpy, role.DeepCopy().(*disgord.Role))
+		}
+	}
+	return cpy
+}
+
+// Used to deep copy a slice of emojis, skipping any nil entries.
+func copyEmojis(emojis []*disgord.Emoji) []*disgord.Emoji {
+	cpy := make([]*disgord.Emoji, 0, len(emojis))
+	for _, emoji := range emojis {
+		if emoji != nil {
+			cpy = append(cpy, emoji.DeepCopy().(*disgord.Emoji))
+		}
+	}
+	return cpy
+}
+
+// Used to deep copy a member.
+// The disgord deep copy shares the role slice and drops PremiumSince, so we fix both up here.
+func copyMember(m *disgord.Member) *disgord.Member {
+	cpy := m.DeepCopy().(*disgord.Member)
+	cpy.PremiumSince = m.PremiumSince
+	if m.Roles != nil {
+		cpy.Roles = make([]disgord.Snowflake, len(m.Roles))
+		copy(cpy.Roles, m.Roles)
+	}
+	return cpy
+}
+
+// Used to find a role within a guild. Returns nil if the role does not exist.
+func findRole(guild *disgord.Guild, roleID disgord.Snowflake) *disgord.Role {
+	for _, role := range guild.Roles {
+		if role != nil && role.ID == roleID {
+			return role
+		}
+	}
+	return nil
+}
+
+// Used to merge a possibly partial user into a cached one.
+// Only non-zero fields are copied so that a partial payload does not degrade the cached user.
+func mergeUser(dst, src *disgord.User) {
+	if src.Username != "" {
+		dst.Username = src.Username
+	}
+	if src.Discriminator != 0 {
+		dst.Discriminator = src.Discriminator
+	}
+	if src.Email != "" {
+		dst.Email = src.Email
+	}
+	if src.Avatar != "" {
+		dst.Avatar = src.Avatar
+	}
+	if src.Token != "" {
+		dst.Token = src.Token
+	}
+	if src.Verified {
+		dst.Verified = true
+	}
+	if src.MFAEnabled {
+		dst.MFAEnabled = true
+	}
+	if src.Bot {
+		dst.Bot = true
+	}
+	if src.PremiumType != 0 {
+		dst.PremiumType = src.PremiumType
+	}
+	if src.Locale != "" {
+		dst.Locale = src.Locale
+	}
+	if src.Flags != 0 {
+		dst.Flags = src.Flags
+	}
+	if src.PublicFlags != 0 {
+		dst.PublicFlags = src.PublicFlags
+	}
+}
+
+// Used to merge a channel into a cached one.
+// Only non-zero fields are copied so that a channel from elsewhere does not wipe what the cache already knows.
+func mergeChannel(dst, src *disgord.Channel) {
+	if src.Type != 0 {
+		dst.Type = src.Type
+	}
+	if src.GuildID != 0 {
+		dst.GuildID = src.GuildID
+	}
+	if src.Position != 0 {
+		dst.Position = src.Position
+	}
+	if src.PermissionOverwrites != nil {
+		dst.PermissionOverwrites = src.PermissionOverwrites
+	}
+	if src.Name != "" {
+		dst.Name = src.Name
+	}
+	if src.Topic != "" {
+		dst.Topic = src.Topic
+	}
+	if src.NSFW {
+		dst.NSFW = true
+	}
+	if src.LastMessageID != 0 {
+		dst.LastMessageID = src.LastMessageID
+	}
+	if src.Bitrate != 0 {
+		dst.Bitrate = src.Bitrate
+	}
+	if src.UserLimit != 0 {
+		dst.UserLimit = src.UserLimit
+	}
+	if src.RateLimitPerUser != 0 {
+		dst.RateLimitPerUser = src.RateLimitPerUser
+	}
+	if len(src.Recipients) != 0 {
+		dst.Recipients = src.Recipients
+	}
+	if src.Icon != "" {
+		dst.Icon = src.Icon
+	}
+	if src.OwnerID != 0 {
+		dst.OwnerID = src.OwnerID
+	}
+	if src.ApplicationID != 0 {
+		dst.ApplicationID = src.ApplicationID
+	}
+	if src.ParentID != 0 {
+		dst.ParentID = src.ParentID
+	}
+	if !src.LastPinTimestamp.IsZero() {
+		dst.LastPinTimestamp = src.LastPinTimestamp
+	}
+}
+
+// Used to check if a role is above another in the hierarchy.
+// Roles are ordered by position, and then by ID for ties where the older role is higher.
+func roleIsHigher(a, b *disgord.Role) bool {
+	if a.Position == b.Position {
+		return a.ID < b.ID
+	}
+	return a.Position > b.Position
+}
+
+// Used to copy a guild, respecting ReturnGetGuildMembers.
+// THIS FUNCTION EXPECTS THE GUILD LOCK TO BE HELD!
+func (c *cache) copyGuild(g *disgord.Guild) *disgord.Guild {
+	cpy := copyGuildWithoutMembers(g)
+	if c.ReturnGetGuildMembers {
+		cpy.Members = copyMembers(g.Members)
+	}
+	return cpy
+}
+
+// Used to copy a member list, skipping any nil members.
+// The members are copied here rather than through the guild deep copy so they get the fixes in copyMember.
+func copyMembers(members []*disgord.Member) []*disgord.Member {
+	cpy := make([]*disgord.Member, 0, len(members))
+	for _, member := range members {
+		if member != nil {
+			cpy = append(cpy, copyMember(member))
+		}
+	}
+	return cpy
+}
+
+// Used to copy a guild without touching the member list at all.
+// This is much cheaper than a deep copy for large guilds since members are normally the bulk of the data.
+func copyGuildWithoutMembers(g *disgord.Guild) *disgord.Guild {
+	cpy := &disgord.Guild{}
+	*cpy = *g
+	cpy.Members = nil
+	if g.JoinedAt != nil {
+		joined := *g.JoinedAt
+		cpy.JoinedAt = &joined
+	}
+	if g.Features != nil {
+		cpy.Features = make([]string, len(g.Features))
+		copy(cpy.Features, g.Features)
+	}
+	cpy.Roles = copyRoles(g.Roles)
+	cpy.Emojis = copyEmojis(g.Emojis)
+	cpy.Channels = nil
+	for _, channel := range g.Channels {
+		if channel != nil {
+			cpy.Channels = append(cpy.Channels, channel.DeepCopy().(*disgord.Channel))
+		}
+	}
+	cpy.VoiceStates = nil
+	for _, state := range g.VoiceStates {
+		if state != nil {
+			cpy.VoiceStates = append(cpy.VoiceStates, state.DeepCopy().(*disgord.VoiceState))
+		}
+	}
+	cpy.Presences = nil
+	for _, presence := range g.Presences {
+		if presence != nil {
+			cpy.Presences = append(cpy.Presences, presence.DeepCopy().(*disgord.UserPresence))
+		}
+	}
+	return cpy
+}
+
+func (c *cache) registerChannelRelationship(guildId, channelId disgord.Snowflake) {
+	if guildId == 0 {
+		return
+	}
+	relationships, ok := c.GuildChannelRelationship[guildId]
+	if !ok {
+		relationships = list.New()
+		c.GuildChannelRelationship[guildId] = relationships
+	}
+	for x := relationships.Front(); x != nil; x = x.Next() {
+		if x.Value.(disgord.Snowflake) == channelId {
+			// The channel expired and has come back before the TLRU purged it, so it is still registered.
+			return
+		}
+	}
+	relationships.PushBack(channelId)
+}
+
+func (c *cache) destroyChannelRelationship(guildId, channelId disgord.Snowflake) {
+	if guildId == 0 {
+		return
+	}
+	relationships, ok := c.GuildChannelRelationship[guildId]
+	if !ok {
+		return
+	}
+	for x := relationships.Front(); x != nil; x = x.Next() {
+		if x.Value.(disgord.Snowflake) == channelId {
+			relationships.Remove(x)
+			break
+		}
+	}
+	if relationships.Len() == 0 {
+		delete(c.GuildChannelRelationship, guildId)
+	}
+}
+
+// Used to get a channel from the TLRU.
+// THIS FUNCTION EXPECTS THE CHANNEL LOCK TO BE HELD!
+func (c *cache) getChannel(channelId disgord.Snowflake) (*disgord.Channel, bool) {
+	item, ok := c.Channels.Get(channelId)
+	c.observeGet(storeChannel, ok)
+	if !ok {
+		return nil, false
+	}
+	return item.(*disgord.Channel), true
+}
+
+// Used to get a channel from the TLRU without reviving it, such as when enumerating the channels.
+// THIS FUNCTION EXPECTS THE CHANNEL LOCK TO BE HELD!
+func (c *cache) peekChannel(channelId disgord.Snowflake) (*disgord.Channel, bool) {
+	item, ok := c.Channels.Peek(channelId)
+	if !ok {
+		return nil, false
+	}
+	return item.(*disgord.Channel), true
+}
+
+// Used to delete a channel from the TLRU if it is still there.
+// THIS FUNCTION EXPECTS THE CHANNEL LOCK TO BE HELD FOR WRITING!
+func (c *cache) deleteChannel(channelId disgord.Snowflake) {
+	c.Channels.Delete(channelId)
+}
+
+// Used to store a user in the TLRU.
+// THIS FUNCTION EXPECTS THE USER LOCK TO BE HELD!
+func (c *cache) setUser(user *disgord.User) {
+	c.Users.Set(user.ID, user)
+	c.observeSet(storeUser)
+}
+
+// Used to store a channel in the TLRU.
+// THIS FUNCTION EXPECTS THE CHANNEL LOCK TO BE HELD FOR WRITING!
+func (c *cache) setChannel(channel *disgord.Channel) {
+	c.Channels.Set(channel.ID, channel)
+	c.observeSet(storeChannel)
+}
+
+// Used to remove all channels belonging to a guild along with the relationship list.
+// THIS FUNCTION EXPECTS THE CHANNEL LOCK TO BE HELD!
+func (c *cache) destroyGuildChannels(guildId disgord.Snowflake) {
+	relationships, ok := c.GuildChannelRelationship[guildId]
+	if !ok {
+		return
+	}
+	for x := relationships.Front(); x != nil; x = x.Next() {
+		c.deleteChannel(x.Value.(disgord.Snowflake))
+	}
+	delete(c.GuildChannelRelationship, guildId)
+}
+
+// Used to replace all channels belonging to a guild with copies of the ones given.
+// The messages of the old channels are dropped with them so they don't take up space in the message store.
+// THIS FUNCTION EXPECTS THE CHANNEL LOCK TO BE HELD!
+func (c *cache) replaceGuildChannels(guildId disgord.Snowflake, channels []*disgord.Channel) {
+	c.destroyGuildChannelMessages(guildId)
+	c.destroyGuildChannels(guildId)
+	c.GuildChannelRelationship[guildId] = list.New()
+	for _, channel := range channels {
+		if channel == nil {
+			continue
+		}
+		channelCpy := channel.DeepCopy().(*disgord.Channel)
+		channelCpy.GuildID = guildId
+		// The channel is registered after it is set since setting it can evict the guild's other channels, which changes the list.
+		c.setChannel(channelCpy)
+		c.registerChannelRelationship(guildId, channelCpy.ID)
+	}
+}
+
+// Used to update dst with only the fields present in the raw payload.
+// Decoding straight into dst would also keep absent fields, but arrays are decoded over the existing elements, so stale
+// values leak into the new ones. Instead, the payload is decoded fresh and each present field is copied over whole.
+func mergePresentFields(dst interface{}, data []byte) error {
+	var present map[string]json.RawMessage
+	if err := json.Unmarshal(data, &present); err != nil {
+		return err
+	}
+	dv := reflect.ValueOf(dst).Elem()
+	fresh := reflect.New(dv.Type())
+	if err := json.Unmarshal(data, fresh.Interface()); err != nil {
+		return err
+	}
+	fv := fresh.Elem()
+	for i := 0; i < dv.NumField(); i++ {
+		field := dv.Type().Field(i)
+		if field.PkgPath != "" {
+			// Unexported fields are never decoded.
+			continue
+		}
+		key := strings.Split(field.Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		if _, ok := present[key]; ok {
+			dv.Field(i).Set(fv.Field(i))
+		}
+	}
+	return nil
+}
+
+// Used to get the recipients of a DM channel from the raw payload.
+// The disgord channel type reads these from the wrong key, so they will normally be missing after unmarshalling.
+func parseRecipients(data []byte) []*disgord.User {
+	var holder struct {
+		Recipients []*disgord.User `json:"recipients"`
+	}
+	if err := json.Unmarshal(data, &holder); err != nil {
+		return nil
+	}
+	return holder.Recipients
+}
+
+// Used to get the public flags of a member's user from the raw payload.
+// The disgord user type reads these from the wrong key, so they will normally be missing after unmarshalling.
+func parseMemberUserFlags(data []byte) disgord.UserFlag {
+	var holder struct {
+		User struct {
+			PublicFlags disgord.UserFlag `json:"public_flags"`
+		} `json:"user"`
+	}
+	if err := json.Unmarshal(data, &holder); err != nil {
+		return 0
+	}
+	return holder.User.PublicFlags
+}
+
+// Used to get the public flags of the users of a member chunk from the raw payload, in member order.
+// See parseMemberUserFlags for why this is needed.
+func parseChunkUserFlags(data []byte) []disgord.UserFlag {
+	var holder struct {
+		Members []struct {
+			User struct {
+				PublicFlags disgord.UserFlag `json:"public_flags"`
+			} `json:"user"`
+		} `json:"members"`
+	}
+	if err := json.Unmarshal(data, &holder); err != nil {
+		return nil
+	}
+	flags := make([]disgord.UserFlag, len(holder.Members))
+	for i, member := range holder.Members {
+		flags[i] = member.User.PublicFlags
+	}
+	return flags
+}
+
+// Used to register a user as having a voice state within a guild.
+// If the guild has gone over MaxVoiceStatesPerGuild, the least recently updated voice states are dropped.
+// THIS FUNCTION EXPECTS THE VOICE STATE LOCK TO BE HELD!
+func (c *cache) registerVoiceStateRelationship(guildId, userId disgord.Snowflake) {
+	users, ok := c.GuildVoiceStateRelationship[guildId]
+	if !ok {
+		users = map[disgord.Snowflake]uint64{}
+		c.GuildVoiceStateRelationship[guildId] = users
+	}
+	c.VoiceStateSeq++
+	users[userId] = c.VoiceStateSeq
+	if c.MaxVoiceStatesPerGuild <= 0 {
+		return
+	}
+	for len(users) > c.MaxVoiceStatesPerGuild {
+		var oldestId disgord.Snowflake
+		var oldestSeq uint64
+		for id, seq := range users {
+			if oldestSeq == 0 || seq < oldestSeq {
+				oldestId, oldestSeq = id, seq
+			}
+		}
+		key := voiceStateKey{GuildID: guildId, UserID: oldestId}
+		if item, ok := c.VoiceStates.Peek(key); ok {
+			c.queueVoiceStateEviction(item.(*disgord.VoiceState))
+		}
+		c.VoiceStates.Delete(key)
+		delete(users, oldestId)
+	}
+}
+
+// Used to queue a copy of an evicted voice state for OnVoiceStateEvicted if it is set.
+// THIS FUNCTION EXPECTS THE VOICE STATE LOCK TO BE HELD!
+func (c *cache) queueVoiceStateEviction(state *disgord.VoiceState) {
+	if c.OnVoiceStateEvicted == nil {
+		return
+	}
+	cpy := state.DeepCopy().(*disgord.VoiceState)
+	c.queueEviction(func() {
+		c.OnVoiceStateEvicted(cpy)
+	})
+}
+
+// Used to remove a user from the voice states of a guild.
+// THIS FUNCTION EXPECTS THE VOICE STATE LOCK TO BE HELD!
+func (c *cache) destroyVoiceStateRelationship(guildId, userId disgord.Snowflake) {
+	users, ok := c.GuildVoiceStateRelationship[guildId]
+	if !ok {
+		return
+	}
+	delete(users, userId)
+	if len(users) == 0 {
+		delete(c.GuildVoiceStateRelationship, guildId)
+	}
+}
+
+// Used to remove all voice states belonging to a guild along with the relationships.
+// THIS FUNCTION EXPECTS THE VOICE STATE LOCK TO BE HELD!
+func (c *cache) destroyGuildVoiceStates(guildId disgord.Snowflake) {
+	for userId := range c.GuildVoiceStateRelationship[guildId] {
+		c.VoiceStates.Delete(voiceStateKey{GuildID: guildId, UserID: userId})
+	}
+	delete(c.GuildVoiceStateRelationship, guildId)
+}
+
+// Used to deep copy a message.
+// The disgord deep copy drops the member, mention channels, reference and flags, and shares the mentioned roles.
+func copyMessage(m *disgord.Message) *disgord.Message {
+	cpy := m.DeepCopy().(*disgord.Message)
+	cpy.Flags = m.Flags
+	if m.Member != nil {
+		cpy.Member = copyMember(m.Member)
+	}
+	if m.MentionRoles != nil {
+		cpy.MentionRoles = make([]disgord.Snowflake, len(m.MentionRoles))
+		copy(cpy.MentionRoles, m.MentionRoles)
+	}
+	for _, channel := range m.MentionChannels {
+		if channel != nil {
+			channelCpy := *channel
+			cpy.MentionChannels = append(cpy.MentionChannels, &channelCpy)
+		}
+	}
+	if m.MessageReference != nil {
+		reference := *m.MessageReference
+		cpy.MessageReference = &reference
+	}
+	return cpy
+}
+
+// Used to register a message as belonging to a channel.
+// If the channel has gone over MessageMaxItems, the oldest messages of the channel are dropped.
+// THIS FUNCTION EXPECTS THE MESSAGE LOCK TO BE HELD!
+func (c *cache) registerMessageRelationship(channelId, messageId disgord.Snowflake) {
+	ids := c.ChannelMessageRelationship[channelId]
+	i := sort.Search(len(ids), func(i int) bool {
+		return ids[i] >= messageId
+	})
+	if i < len(ids) && ids[i] == messageId {
+		return
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = messageId
+	for len(ids) > c.MessageMaxItems {
+		c.Messages.Delete(messageKey{ChannelID: channelId, MessageID: ids[0]})
+		ids = ids[1:]
+	}
+	c.ChannelMessageRelationship[channelId] = ids
+}
+
+// Used to remove a message from the relationship of its channel.
+// THIS FUNCTION EXPECTS THE MESSAGE LOCK TO BE HELD!
+func (c *cache) destroyMessageRelationship(channelId, messageId disgord.Snowflake) {
+	ids := c.ChannelMessageRelationship[channelId]
+	i := sort.Search(len(ids), func(i int) bool {
+		return ids[i] >= messageId
+	})
+	if i == len(ids) || ids[i] != messageId {
+		return
+	}
+	if len(ids) == 1 {
+		delete(c.ChannelMessageRelationship, channelId)
+		return
+	}
+	c.ChannelMessageRelationship[channelId] = append(ids[:i], ids[i+1:]...)
+}
+
+// Used to remove a message and its relationship.
+// THIS FUNCTION EXPECTS THE MESSAGE LOCK TO BE HELD!
+func (c *cache) destroyMessage(channelId, messageId disgord.Snowflake) {
+	c.Messages.Delete(messageKey{ChannelID: channelId, MessageID: messageId})
+	c.destroyMessageRelationship(channelId, messageId)
+}
+
+// Used to remove all messages belonging to a channel.
+func (c *cache) destroyChannelMessages(channelId disgord.Snowflake) {
+	if c.Messages == nil {
+		return
+	}
+	c.Messages.Lock()
+	defer c.Messages.Unlock()
+	for _, messageId := range c.ChannelMessageRelationship[channelId] {
+		c.Messages.Delete(messageKey{ChannelID: channelId, MessageID: messageId})
+	}
+	delete(c.ChannelMessageRelationship, channelId)
+}
+
+// Used to remove all messages belonging to the channels of a guild.
+// THIS FUNCTION EXPECTS THE CHANNEL LOCK TO BE HELD!
+func (c *cache) destroyGuildChannelMessages(guildId disgord.Snowflake) {
+	relationships, ok := c.GuildChannelRelationship[guildId]
+	if !ok {
+		return
+	}
+	for x := relationships.Front(); x != nil; x = x.Next() {
+		c.destroyChannelMessages(x.Value.(disgord.Snowflake))
+	}
+}
+
+// Used to register the recipient of a DM channel so the channel can be found by user.
+// Group DM's are not registered since they do not belong to any single user.
+// THIS FUNCTION EXPECTS THE CHANNEL LOCK TO BE HELD!
+func (c *cache) registerDMRelationship(channel *disgord.Channel, data []byte) {
+	if channel.Type == disgord.ChannelTypeDM || channel.Type == disgord.ChannelTypeGroupDM {
+		if len(channel.Recipients) == 0 {
+			channel.Recipients = parseRecipients(data)
+		}
+	}
+	if channel.Type != disgord.ChannelTypeDM {
+		return
+	}
+	for _, recipient := range channel.Recipients {
+		c.DMChannelRelationship[recipient.ID] = channel.ID
+	}
+}
+
+// Used to remove a DM channel from the recipient relationships.
+// THIS FUNCTION EXPECTS THE CHANNEL LOCK TO BE HELD!
+func (c *cache) destroyDMRelationship(channelId disgord.Snowflake) {
+	for userId, dmId := range c.DMChannelRelationship {
+		if dmId == channelId {
+			delete(c.DMChannelRelationship, userId)
+		}
+	}
+}
+
+func (c *cache) Ready(data []byte) (evt *disgord.Ready, err error) {
+	defer c.runPostHandlers(disgord.EvtReady, data, &err)
+	defer c.recoverHandler("Ready", &evt, &err)
+
+	c.CurrentUserMu.Lock()
+	defer c.CurrentUserMu.Unlock()
+
+	rdy := &disgord.Ready{
+		User: c.CurrentUser,
+	}
+
+	err = json.Unmarshal(data, rdy)
+	return rdy, err
+}
+
+func (c *cache) ChannelCreate(data []byte) (evt *disgord.ChannelCreate, err error) {
+	defer c.runPostHandlers(disgord.EvtChannelCreate, data, &err)
+	defer c.recoverHandler("ChannelCreate", &evt, &err)
+
+	wrap := func(c *disgord.Channel) *disgord.ChannelCreate {
+		return &disgord.ChannelCreate{Channel: c}
+	}
+
+	var channel *disgord.Channel
+	if err := json.Unmarshal(data, &channel); err != nil {
+		return &disgord.ChannelCreate{}, err
+	}
+	if channel == nil {
+		return &disgord.ChannelCreate{}, nil
+	}
+	c.touchGuild(channel.GuildID)
+
+	defer c.checkChannelConsistency()
+	c.ChannelMu.Lock()
+	defer c.ChannelMu.Unlock()
+	if wrapper, exists := c.getChannel(channel.ID); exists {
+		err := json.Unmarshal(data, wrapper)
+		return wrap(channel), err
+	}
+
+	c.setChannel(channel)
+	c.registerChannelRelationship(channel.GuildID, channel.ID)
+	c.registerDMRelationship(channel, data)
+
+	return wrap(channel), nil
+}
+
+func (c *cache) ChannelUpdate(data []byte) (evt *disgord.ChannelUpdate, err error) {
+	defer c.runPostHandlers(disgord.EvtChannelUpdate, data, &err)
+	defer c.recoverHandler("ChannelUpdate", &evt, &err)
+
+	var metadata *idHolder
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return &disgord.ChannelUpdate{}, err
+	}
+	if metadata == nil {
+		return &disgord.ChannelUpdate{}, nil
+	}
+	channelID := metadata.ID
+
+	defer c.checkChannelConsistency()
+	c.ChannelMu.Lock()
+	defer c.ChannelMu.Unlock()
+
+	var channel *disgord.Channel
+	var exists bool
+	if channel, exists = c.getChannel(channelID); exists {
+		if err := mergePresentFields(channel, data); err != nil {
+			return &disgord.ChannelUpdate{}, err
+		}
+	} else {
+		if err := json.Unmarshal(data, &channel); err != nil {
+			return &disgord.ChannelUpdate{}, err
+		}
+		c.setChannel(channel)
+		c.registerChannelRelationship(channel.GuildID, channel.ID)
+		c.registerDMRelationship(channel, data)
+	}
+	c.touchGuild(channel.GuildID)
+
+	return &disgord.ChannelUpdate{Channel: channel}, nil
+}
+
+func (c *cache) ChannelDelete(data []byte) (evt *disgord.ChannelDelete, err error) {
+	defer c.runPostHandlers(disgord.EvtChannelDelete, data, &err)
+	defer c.recoverHandler("ChannelDelete", &evt, &err)
+
+	var cd *disgord.ChannelDelete
+	if err := json.Unmarshal(data, &cd); err != nil {
+		return &disgord.ChannelDelete{}, err
+	}
+	if cd == nil {
+		return &disgord.ChannelDelete{}, nil
+	}
+	if cd.Channel == nil {
+		return cd, nil
+	}
+	c.touchGuild(cd.Channel.GuildID)
+
+	defer c.checkChannelConsistency()
+	c.ChannelMu.Lock()
+	defer c.ChannelMu.Unlock()
+	c.deleteChannel(cd.Channel.ID)
+	c.destroyChannelRelationship(cd.Channel.GuildID, cd.Channel.ID)
+	c.destroyDMRelationship(cd.Channel.ID)
+	c.destroyChannelMessages(cd.Channel.ID)
+
+	return cd, nil
+}
+
+// Used to check if messages are cached for a channel.
+func (c *cache) cachesMessages(channelID disgord.Snowflake) bool {
+	if c.Messages == nil {
+		return false
+	}
+	if c.MessageChannels == nil {
+		return true
+	}
+	_, ok := c.MessageChannels[channelID]
+	return ok
+}
+
+func (c *cache) MessageCreate(data []byte) (evt *disgord.MessageCreate, err error) {
+	defer c.runPostHandlers(disgord.EvtMessageCreate, data, &err)
+	defer c.recoverHandler("MessageCreate", &evt, &err)
+
+	var msgEvt *disgord.MessageCreate
+	if err := json.Unmarshal(data, &msgEvt); err != nil {
+		return &disgord.MessageCreate{}, err
+	}
+	if msgEvt == nil {
+		return &disgord.MessageCreate{}, nil
+	}
+	if msgEvt.Message == nil {
+		return msgEvt, nil
+	}
+	c.touchGuild(msgEvt.Message.GuildID)
+	if !c.cachesMessages(msgEvt.Message.ChannelID) {
+		return msgEvt, nil
+	}
+
+	msg := msgEvt.Message
+	c.Messages.Lock()
+	defer c.Messages.Unlock()
+	c.Messages.Set(messageKey{ChannelID: msg.ChannelID, MessageID: msg.ID}, copyMessage(msg))
+	c.observeSet(storeMessage)
+	c.registerMessageRelationship(msg.ChannelID, msg.ID)
+
+	return msgEvt, nil
+}
+
+func (c *cache) MessageUpdate(data []byte) (evt *disgord.MessageUpdate, err error) {
+	defer c.runPostHandlers(disgord.EvtMessageUpdate, data, &err)
+	defer c.recoverHandler("MessageUpdate", &evt, &err)
+
+	var msgEvt *disgord.MessageUpdate
+	if err := json.Unmarshal(data, &msgEvt); err != nil {
+		return &disgord.MessageUpdate{}, err
+	}
+	if msgEvt == nil {
+		return &disgord.MessageUpdate{}, nil
+	}
+	if msgEvt.Message == nil {
+		return msgEvt, nil
+	}
+	c.touchGuild(msgEvt.Message.GuildID)
+	if !c.cachesMessages(msgEvt.Message.ChannelID) {
+		return msgEvt, nil
+	}
+
+	// Updates are often partial, so we only merge them into messages we already have.
+	c.Messages.Lock()
+	defer c.Messages.Unlock()
+	if item, exists := c.Messages.Get(messageKey{ChannelID: msgEvt.Message.ChannelID, MessageID: msgEvt.Message.ID}); exists {
+		if err := mergePresentFields(item, data); err != nil {
+			return &disgord.MessageUpdate{}, err
+		}
+	}
+
+	return msgEvt, nil
+}
+
+func (c *cache) MessageDelete(data []byte) (evt *disgord.MessageDelete, err error) {
+	defer c.runPostHandlers(disgord.EvtMessageDelete, data, &err)
+	defer c.recoverHandler("MessageDelete", &evt, &err)
+
+	var msgEvt *disgord.MessageDelete
+	if err := json.Unmarshal(data, &msgEvt); err != nil {
+		return &disgord.MessageDelete{}, err
+	}
+	if msgEvt == nil {
+		return &disgord.MessageDelete{}, nil
+	}
+	c.touchGuild(msgEvt.GuildID)
+	if !c.cachesMessages(msgEvt.ChannelID) {
+		return msgEvt, nil
+	}
+
+	c.Messages.Lock()
+	defer c.Messages.Unlock()
+	c.destroyMessage(msgEvt.ChannelID, msgEvt.MessageID)
+
+	return msgEvt, nil
+}
+
+func (c *cache) MessageDeleteBulk(data []byte) (evt *disgord.MessageDeleteBulk, err error) {
+	defer c.runPostHandlers(disgord.EvtMessageDeleteBulk, data, &err)
+	defer c.recoverHandler("MessageDeleteBulk", &evt, &err)
+
+	var msgEvt *disgord.MessageDeleteBulk
+	if err := json.Unmarshal(data, &msgEvt); err != nil {
+		return &disgord.MessageDeleteBulk{}, err
+	}
+	if msgEvt == nil {
+		return &disgord.MessageDeleteBulk{}, nil
+	}
+	if !c.cachesMessages(msgEvt.ChannelID) {
+		return msgEvt, nil
+	}
+
+	c.Messages.Lock()
+	defer c.Messages.Unlock()
+	for _, messageID := range msgEvt.MessageIDs {
+		c.destroyMessage(msgEvt.ChannelID, messageID)
+	}
+
+	return msgEvt, nil
+}
+
+func (c *cache) ChannelPinsUpdate(data []byte) (evt *disgord.ChannelPinsUpdate, err error) {
+	defer c.runPostHandlers(disgord.EvtChannelPinsUpdate, data, &err)
+	defer c.recoverHandler("ChannelPinsUpdate", &evt, &err)
+
+	var cpu *disgord.ChannelPinsUpdate
+	if err := json.Unmarshal(data, &cpu); err != nil {
+		return &disgord.ChannelPinsUpdate{}, err
+	}
+
+	if cpu == nil {
+		return &disgord.ChannelPinsUpdate{}, nil
+	}
+	c.touchGuild(cpu.GuildID)
+
+	if cpu.LastPinTimestamp.IsZero() {
+		return cpu, nil
+	}
+
+	c.ChannelMu.Lock()
+	defer c.ChannelMu.Unlock()
+	if channel, exists := c.getChannel(cpu.ChannelID); exists {
+		channel.LastPinTimestamp = cpu.LastPinTimestamp
+	}
+
+	return cpu, nil
+}
+
+func (c *cache) UserUpdate(data []byte) (evt *disgord.UserUpdate, err error) {
+	defer c.runPostHandlers(disgord.EvtUserUpdate, data, &err)
+	defer c.recoverHandler("UserUpdate", &evt, &err)
+
+	c.CurrentUserMu.Lock()
+	defer c.CurrentUserMu.Unlock()
+	update := &disgord.UserUpdate{User: c.CurrentUser}
+	if err := json.Unmarshal(data, update); err != nil {
+		return &disgord.UserUpdate{}, err
+	}
+
+	return update, nil
+}
+
+func (c *cache) VoiceStateUpdate(data []byte) (evt *disgord.VoiceStateUpdate, err error) {
+	defer c.runPostHandlers(disgord.EvtVoiceStateUpdate, data, &err)
+	defer c.recoverHandler("VoiceStateUpdate", &evt, &err)
+	defer c.reportEvictions()
+
+	var vsu *disgord.VoiceStateUpdate
+	if err := json.Unmarshal(data, &vsu); err != nil {
+		return &disgord.VoiceStateUpdate{}, err
+	}
+	if vsu == nil {
+		return &disgord.VoiceStateUpdate{}, nil
+	}
+	if vsu.VoiceState == nil {
+		return vsu, nil
+	}
+	c.touchGuild(vsu.GuildID)
+
+	c.CurrentUserMu.Lock()
+	isBot := c.CurrentUser != nil && c.CurrentUser.ID == vsu.UserID
+	c.CurrentUserMu.Unlock()
+	if isBot && !vsu.ChannelID.IsZero() {
+		// Revive the guild whilst we are in voice there so it is not evicted underneath the connection.
+		func() {
+			c.Guilds.LockKey(vsu.GuildID)
+			defer c.Guilds.UnlockKey(vsu.GuildID)
+			c.Guilds.Get(vsu.GuildID)
+		}()
+	}
+
+	key := voiceStateKey{GuildID: vsu.GuildID, UserID: vsu.UserID}
+	c.VoiceStates.Lock()
+	defer c.VoiceStates.Unlock()
+	if vsu.ChannelID.IsZero() {
+		// The user left voice, so we should forget their state entirely.
+		c.VoiceStates.Delete(key)
+		c.destroyVoiceStateRelationship(vsu.GuildID, vsu.UserID)
+	} else {
+		c.VoiceStates.Set(key, vsu.VoiceState.DeepCopy().(*disgord.VoiceState))
+		c.observeSet(storeVoiceState)
+		c.registerVoiceStateRelationship(vsu.GuildID, vsu.UserID)
+	}
+
+	return vsu, nil
+}
+
+func (c *cache) VoiceServerUpdate(data []byte) (evt *disgord.VoiceServerUpdate, err error) {
+	defer c.runPostHandlers(disgord.EvtVoiceServerUpdate, data, &err)
+	defer c.recoverHandler("VoiceServerUpdate", &evt, &err)
+
+	var vsu *disgord.VoiceServerUpdate
+	if err := json.Unmarshal(data, &vsu); err != nil {
+		return &disgord.VoiceServerUpdate{}, err
+	}
+	if vsu == nil {
+		return &disgord.VoiceServerUpdate{}, nil
+	}
+	if !c.StoreVoiceServers {
+		return vsu, nil
+	}
+
+	cpy := &disgord.VoiceServerUpdate{Token: vsu.Token, GuildID: vsu.GuildID, Endpoint: vsu.Endpoint}
+	c.VoiceServerMu.Lock()
+	c.VoiceServers[vsu.GuildID] = cpy
+	c.VoiceServerMu.Unlock()
+
+	return vsu, nil
+}
+
+func (c *cache) GuildMemberRemove(data []byte) (evt *disgord.GuildMemberRemove, err error) {
+	defer c.runPostHandlers(disgord.EvtGuildMemberRemove, data, &err)
+	defer c.recoverHandler("GuildMemberRemove", &evt, &err)
+
+	var gmr *disgord.GuildMemberRemove
+	if err := json.Unmarshal(data, &gmr); err != nil {
+		return &disgord.GuildMemberRemove{}, err
+	}
+	if gmr == nil {
+		return &disgord.GuildMemberRemove{}, nil
+	}
+	if gmr.User == nil {
+		return gmr, nil
+	}
+	c.touchGuild(gmr.GuildID)
+
+	defer c.checkGuildConsistency(gmr.GuildID)
+	c.Guilds.LockKey(gmr.GuildID)
+	defer c.Guilds.UnlockKey(gmr.GuildID)
+
+	if guild, exists := c.getCachedGuild(gmr.GuildID); exists {
+		if guild.removeMember(gmr.User.ID) && guild.Guild.MemberCount > 0 {
+			guild.Guild.MemberCount--
+		}
+	}
+
+	return gmr, nil
+}
+
+func (c *cache) GuildBanAdd(data []byte) (evt *disgord.GuildBanAdd, err error) {
+	defer c.runPostHandlers(disgord.EvtGuildBanAdd, data, &err)
+	defer c.recoverHandler("GuildBanAdd", &evt, &err)
+
+	var ban *disgord.GuildBanAdd
+	if err := json.Unmarshal(data, &ban); err != nil {
+		return &disgord.GuildBanAdd{}, err
+	}
+	if ban == nil {
+		return &disgord.GuildBanAdd{}, nil
+	}
+	if ban.User == nil {
+		return ban, nil
+	}
+	c.touchGuild(ban.GuildID)
+
+	// Discord also sends a member remove for the ban, but removing the member here means it is gone straight away.
+	// The member count is only decremented if the member was cached, so the remove event does not decrement it twice.
+	defer c.checkGuildConsistency(ban.GuildID)
+	c.Guilds.LockKey(ban.GuildID)
+	defer c.Guilds.UnlockKey(ban.GuildID)
+
+	if guild, exists := c.getCachedGuild(ban.GuildID); exists {
+		if guild.removeMember(ban.User.ID) && guild.Guild.MemberCount > 0 {
+			guild.Guild.MemberCount--
+		}
+	}
+
+	return ban, nil
+}
+
+func (c *cache) GuildBanRemove(data []byte) (evt *disgord.GuildBanRemove, err error) {
+	defer c.runPostHandlers(disgord.EvtGuildBanRemove, data, &err)
+	defer c.recoverHandler("GuildBanRemove", &evt, &err)
+
+	var unban *disgord.GuildBanRemove
+	if err := json.Unmarshal(data, &unban); err != nil {
+		return &disgord.GuildBanRemove{}, err
+	}
+	if unban == nil {
+		return &disgord.GuildBanRemove{}, nil
+	}
+	// Unbanning a user does not make them a member again, so there is nothing to update.
+	c.touchGuild(unban.GuildID)
+	return unban, nil
+}
+
+func (c *cache) GuildMemberAdd(data []byte) (evt *disgord.GuildMemberAdd, err error) {
+	defer c.runPostHandlers(disgord.EvtGuildMemberAdd, data, &err)
+	defer c.recoverHandler("GuildMemberAdd", &evt, &err)
+	defer c.reportEvictions()
+
+	var gmr *disgord.GuildMemberAdd
+	if err := json.Unmarshal(data, &gmr); err != nil {
+		return &disgord.GuildMemberAdd{}, err
+	}
+	if gmr == nil {
+		return &disgord.GuildMemberAdd{}, nil
+	}
+	if gmr.Member == nil || gmr.Member.User == nil {
+		return gmr, nil
+	}
+	c.Patch(gmr)
+	c.touchGuild(gmr.Member.GuildID)
+
+	if gmr.Member.User.PublicFlags == 0 {
+		gmr.Member.User.PublicFlags = parseMemberUserFlags(data)
+	}
+	setUser := func() {
+		c.Users.Lock()
+		defer c.Users.Unlock()
+		if item, exists := c.Users.Get(gmr.Member.User.ID); exists {
+			mergeUser(item.(*disgord.User), gmr.Member.User)
+		} else {
+			c.setUser(gmr.Member.User)
+		}
+	}
+	setUser()
+
+	defer c.checkGuildConsistency(gmr.Member.GuildID)
+	c.Guilds.LockKey(gmr.Member.GuildID)
+	defer c.Guilds.UnlockKey(gmr.Member.GuildID)
+
+	if guild, exists := c.getCachedGuild(gmr.Member.GuildID); exists {
+		member := guild.member(gmr.Member.User.ID)
+		if member != nil {
+			if err := json.Unmarshal(data, member); err != nil {
+				return &disgord.GuildMemberAdd{}, err
+			}
+		} else {
+			member = &disgord.Member{}
+			*member = *gmr.Member
+
+			guild.addMember(member)
+			guild.Guild.MemberCount++
+		}
+		member.User = nil
+	}
+
+	return gmr, nil
+}
+
+func (c *cache) GuildMembersChunk(data []byte) (evt *disgord.GuildMembersChunk, err error) {
+	defer c.runPostHandlers(disgord.EvtGuildMembersChunk, data, &err)
+	defer c.recoverHandler("GuildMembersChunk", &evt, &err)
+	defer c.reportEvictions()
+
+	var chunk *disgord.GuildMembersChunk
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return &disgord.GuildMembersChunk{}, err
+	}
+	if chunk == nil {
+		return &disgord.GuildMembersChunk{}, nil
+	}
+	// Patch walks the members, so any null members have to be dropped before it is called.
+	// The flags are filtered alongside them so that they still line up.
+	flags := parseChunkUserFlags(data)
+	members := chunk.Members[:0]
+	memberFlags := flags[:0]
+	for i, member := range chunk.Members {
+		if member == nil {
+			continue
+		}
+		members = append(members, member)
+		if i < len(flags) {
+			memberFlags = append(memberFlags, flags[i])
+		}
+	}
+	chunk.Members = members
+	flags = memberFlags
+	c.Patch(chunk)
+	c.touchGuild(chunk.GuildID)
+
+	setUsers := func() {
+		c.Users.Lock()
+		defer c.Users.Unlock()
+		for i, member := range chunk.Members {
+			if member == nil || member.User == nil {
+				continue
+			}
+			if member.User.PublicFlags == 0 && i < len(flags) {
+				member.User.PublicFlags = flags[i]
+			}
+			if item, exists := c.Users.Get(member.User.ID); exists {
+				mergeUser(item.(*disgord.User), member.User)
+			} else {
+				c.setUser(member.User.DeepCopy().(*disgord.User))
+			}
+		}
+	}
+	setUsers()
+
+	defer c.checkGuildConsistency(chunk.GuildID)
+	c.Guilds.LockKey(chunk.GuildID)
+	defer c.Guilds.UnlockKey(chunk.GuildID)
+
+	// Chunks only contain existing members of the guild, so the member count is only raised if it is behind the loaded members.
+	// This also means a chunk being delivered twice can't throw the count off.
+	if guild, exists := c.getCachedGuild(chunk.GuildID); exists {
+		for _, member := range chunk.Members {
+			if member == nil || member.User == nil {
+				continue
+			}
+			cpy := copyMember(member)
+			cpy.GuildID = chunk.GuildID
+			cpy.User = nil
+			if existing := guild.member(cpy.UserID); existing != nil {
+				*existing = *cpy
+			} else {
+				guild.addMember(cpy)
+			}
+		}
+		guild.countLoadedMembers()
+	}
+
+	return chunk, nil
+}
+
+func (c *cache) GuildCreate(data []byte) (evt *disgord.GuildCreate, err error) {
+	defer c.runPostHandlers(disgord.EvtGuildCreate, data, &err)
+	defer c.recoverHandler("GuildCreate", &evt, &err)
+	defer c.reportEvictions()
+
+	var guildEvt *disgord.GuildCreate
+	if err := json.Unmarshal(data, &guildEvt); err != nil {
+		return &disgord.GuildCreate{}, err
+	}
+	if guildEvt == nil {
+		return &disgord.GuildCreate{}, nil
+	}
+	if guildEvt.Guild == nil {
+		return guildEvt, nil
+	}
+	// This is deferred so the guild is cached by the time the event is recorded.
+	defer c.touchGuild(guildEvt.Guild.ID)
+
+	defer c.checkChannelConsistency()
+	defer c.checkGuildConsistency(guildEvt.Guild.ID)
+	c.Guilds.LockKey(guildEvt.Guild.ID)
+	defer c.Guilds.UnlockKey(guildEvt.Guild.ID)
+
+	setChannels := func() {
+		c.ChannelMu.Lock()
+		defer c.ChannelMu.Unlock()
+		c.replaceGuildChannels(guildEvt.Guild.ID, guildEvt.Guild.Channels)
+	}
+
+	setVoiceStates := func() {
+		// Any voice states we still have for this guild are from before, so we should remove them.
+		c.VoiceStates.Lock()
+		defer c.VoiceStates.Unlock()
+		c.destroyGuildVoiceStates(guildEvt.Guild.ID)
+		for _, state := range guildEvt.Guild.VoiceStates {
+			if state.ChannelID.IsZero() {
+				continue
+			}
+			cpy := state.DeepCopy().(*disgord.VoiceState)
+			cpy.GuildID = guildEvt.Guild.ID
+			c.VoiceStates.Set(voiceStateKey{GuildID: cpy.GuildID, UserID: cpy.UserID}, cpy)
+			c.observeSet(storeVoiceState)
+			c.registerVoiceStateRelationship(cpy.GuildID, cpy.UserID)
+		}
+	}
+
+	if entry, exists := c.getCachedGuild(guildEvt.Guild.ID); exists && !entry.Guild.Unavailable {
+		// The guild is already available, such as after a resume or when an update came before the create.
+		// The create is merged in so that it is idempotent, keeping any members which were loaded since.
+		members := entry.Guild.Members
+		entry.Guild.Members = nil
+		if err := mergePresentFields(entry.Guild, data); err != nil {
+			entry.Guild.Members = members
+			return &disgord.GuildCreate{}, err
+		}
+		// Appending the members from the create last means they take priority when the index is rebuilt.
+		entry.Guild.Members = append(members, entry.Guild.Members...)
+		entry.indexMembers()
+	} else {
+		c.setGuild(guildEvt.Guild)
+	}
+	setChannels()
+	setVoiceStates()
+
+	return guildEvt, nil
+}
+
+func (c *cache) GuildUpdate(data []byte) (evt *disgord.GuildUpdate, err error) {
+	defer c.runPostHandlers(disgord.EvtGuildUpdate, data, &err)
+	defer c.recoverHandler("GuildUpdate", &evt, &err)
+	defer c.reportEvictions()
+
+	var guildEvt *disgord.GuildUpdate
+	if err := json.Unmarshal(data, &guildEvt); err != nil {
+		return &disgord.GuildUpdate{}, err
+	}
+	if guildEvt == nil {
+		return &disgord.GuildUpdate{}, nil
+	}
+	if guildEvt.Guild == nil {
+		return guildEvt, nil
+	}
+	// The guild from the event may become the cached guild, which other updates decode into once the lock is released.
+	guildId := guildEvt.Guild.ID
+	c.touchGuild(guildId)
+
+	defer c.checkGuildConsistency(guildId)
+	rolesChanged, emojisChanged, err := c.updateGuild(guildEvt.Guild, data)
+	if err != nil {
+		return &disgord.GuildUpdate{}, err
+	}
+
+	c.fireGuildCallbacks(guildId, rolesChanged, emojisChanged)
+
+	return guildEvt, nil
+}
+
+// Used to fire the callbacks for a guild whose roles or emojis changed.
+// THIS FUNCTION EXPECTS THE GUILD LOCK TO BE RELEASED! This leaves the callbacks free to read from the cache.
+func (c *cache) fireGuildCallbacks(guildId disgord.Snowflake, rolesChanged, emojisChanged bool) {
+	if rolesChanged && c.OnRolesChanged != nil {
+		c.OnRolesChanged(guildId)
+	}
+	if emojisChanged && c.OnEmojisChanged != nil {
+		c.OnEmojisChanged(guildId)
+	}
+}
+
+// Used to apply a guild update to the cache, reporting if the roles or emojis changed.
+// The changes are only worked out when the respective callback is set since it means copying the collections.
+func (c *cache) updateGuild(updated *disgord.Guild, data []byte) (rolesChanged, emojisChanged bool, err error) {
+	c.Guilds.LockKey(updated.ID)
+	defer c.Guilds.UnlockKey(updated.ID)
+
+	oldRoles := []*disgord.Role{}
+	oldEmojis := []*disgord.Emoji{}
+	guild := updated
+	if entry, exists := c.getCachedGuild(updated.ID); exists {
+		existing := entry.Guild
+		// Decoding in place reuses the existing role and emoji pointers, so these need to be copied first.
+		if c.OnRolesChanged != nil {
+			oldRoles = copyRoles(existing.Roles)
+		}
+		if c.OnEmojisChanged != nil {
+			oldEmojis = copyEmojis(existing.Emojis)
+		}
+		if existing.Unavailable {
+			c.setGuild(updated)
+		} else if err := json.Unmarshal(data, existing); err != nil {
+			return false, false, err
+		} else {
+			// The update may have carried members, so the index has to be rebuilt.
+			entry.indexMembers()
+			guild = existing
+		}
+	} else {
+		c.setGuild(updated)
+	}
+
+	if c.OnRolesChanged != nil {
+		rolesChanged = !reflect.DeepEqual(oldRoles, copyRoles(guild.Roles))
+	}
+	if c.OnEmojisChanged != nil {
+		emojisChanged = !reflect.DeepEqual(oldEmojis, copyEmojis(guild.Emojis))
+	}
+	return rolesChanged, emojisChanged, nil
+}
+
+func (c *cache) GuildDelete(data []byte) (evt *disgord.GuildDelete, err error) {
+	defer c.runPostHandlers(disgord.EvtGuildDelete, data, &err)
+	defer c.recoverHandler("GuildDelete", &evt, &err)
+
+	var guildEvt *disgord.GuildDelete
+	if err := json.Unmarshal(data, &guildEvt); err != nil {
+		return &disgord.GuildDelete{}, err
+	}
+	if guildEvt == nil {
+		return &disgord.GuildDelete{}, nil
+	}
+	if guildEvt.UnavailableGuild == nil {
+		return guildEvt, nil
+	}
+
+	defer c.checkChannelConsistency()
+	c.Guilds.LockKey(guildEvt.UnavailableGuild.ID)
+	defer c.Guilds.UnlockKey(guildEvt.UnavailableGuild.ID)
+	c.destroyGuild(guildEvt.UnavailableGuild.ID)
+
+	return guildEvt, nil
+}
+
+func (c *cache) GuildEmojisUpdate(data []byte) (evt *disgord.GuildEmojisUpdate, err error) {
+	defer c.runPostHandlers(disgord.EvtGuildEmojisUpdate, data, &err)
+	defer c.recoverHandler("GuildEmojisUpdate", &evt, &err)
+
+	var emojiEvt *disgord.GuildEmojisUpdate
+	if err := json.Unmarshal(data, &emojiEvt); err != nil {
+		return &disgord.GuildEmojisUpdate{}, err
+	}
+	if emojiEvt == nil {
+		return &disgord.GuildEmojisUpdate{}, nil
+	}
+	c.touchGuild(emojiEvt.GuildID)
+
+	defer c.checkGuildConsistency(emojiEvt.GuildID)
+	c.fireGuildCallbacks(emojiEvt.GuildID, false, c.updateGuildEmojis(emojiEvt.GuildID, emojiEvt.Emojis))
+
+	return emojiEvt, nil
+}
+
+// Used to replace the emojis of a cached guild, reporting if they changed. Nothing happens if the guild is not cached.
+// The change is only worked out when OnEmojisChanged is set since it means copying the emojis.
+func (c *cache) updateGuildEmojis(guildId disgord.Snowflake, emojis []*disgord.Emoji) (changed bool) {
+	c.Guilds.LockKey(guildId)
+	defer c.Guilds.UnlockKey(guildId)
+	guild, exists := c.getGuild(guildId)
+	if !exists {
+		return false
+	}
+	cpy := copyEmojis(emojis)
+	if c.OnEmojisChanged != nil {
+		changed = !reflect.DeepEqual(copyEmojis(guild.Emojis), cpy)
+	}
+	guild.Emojis = cpy
+	return changed
+}
+
+func (c *cache) GuildRoleCreate(data []byte) (evt *disgord.GuildRoleCreate, err error) {
+	defer c.runPostHandlers(disgord.EvtGuildRoleCreate, data, &err)
+	defer c.recoverHandler("GuildRoleCreate", &evt, &err)
+
+	var roleEvt *disgord.GuildRoleCreate
+	if err := json.Unmarshal(data, &roleEvt); err != nil {
+		return &disgord.GuildRoleCreate{}, err
+	}
+	if roleEvt == nil {
+		return &disgord.GuildRoleCreate{}, nil
+	}
+	if roleEvt.Role == nil {
+		return roleEvt, nil
+	}
+	c.touchGuild(roleEvt.GuildID)
+
+	defer c.checkGuildConsistency(roleEvt.GuildID)
+	c.Guilds.LockKey(roleEvt.GuildID)
+	defer c.Guilds.UnlockKey(roleEvt.GuildID)
+
+	if guild, exists := c.getGuild(roleEvt.GuildID); exists {
+		role := roleEvt.Role.DeepCopy().(*disgord.Role)
+		replaced := false
+		for i, existing := range guild.Roles {
+			if existing != nil && existing.ID == role.ID {
+				// We somehow already know about this role, so replace it rather than have it twice.
+				guild.Roles[i] = role
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			guild.Roles = append(guild.Roles, role)
+		}
+	}
+
+	return roleEvt, nil
+}
+
+func (c *cache) GuildRoleUpdate(data []byte) (evt *disgord.GuildRoleUpdate, err error) {
+	defer c.runPostHandlers(disgord.EvtGuildRoleUpdate, data, &err)
+	defer c.recoverHandler("GuildRoleUpdate", &evt, &err)
+
+	var roleEvt *disgord.GuildRoleUpdate
+	if err := json.Unmarshal(data, &roleEvt); err != nil {
+		return &disgord.GuildRoleUpdate{}, err
+	}
+	if roleEvt == nil {
+		return &disgord.GuildRoleUpdate{}, nil
+	}
+	if roleEvt.Role == nil {
+		return roleEvt, nil
+	}
+	c.touchGuild(roleEvt.GuildID)
+
+	defer c.checkGuildConsistency(roleEvt.GuildID)
+	c.Guilds.LockKey(roleEvt.GuildID)
+	defer c.Guilds.UnlockKey(roleEvt.GuildID)
+
+	if guild, exists := c.getGuild(roleEvt.GuildID); exists {
+		role := findRole(guild, roleEvt.Role.ID)
+		if role == nil {
+			guild.Roles = append(guild.Roles, roleEvt.Role.DeepCopy().(*disgord.Role))
+		} else {
+			var raw struct {
+				Role json.RawMessage `json:"role"`
+			}
+			if err := json.Unmarshal(data, &raw); err != nil {
+				return &disgord.GuildRoleUpdate{}, err
+			}
+			if err := json.Unmarshal(raw.Role, role); err != nil {
+				return &disgord.GuildRoleUpdate{}, err
+			}
+		}
+	}
+
+	return roleEvt, nil
+}
+
+func (c *cache) GuildRoleDelete(data []byte) (evt *disgord.GuildRoleDelete, err error) {
+	defer c.runPostHandlers(disgord.EvtGuildRoleDelete, data, &err)
+	defer c.recoverHandler("GuildRoleDelete", &evt, &err)
+
+	var roleEvt *disgord.GuildRoleDelete
+	if err := json.Unmarshal(data, &roleEvt); err != nil {
+		return &disgord.GuildRoleDelete{}, err
+	}
+	if roleEvt == nil {
+		return &disgord.GuildRoleDelete{}, nil
+	}
+	c.touchGuild(roleEvt.GuildID)
+
+	defer c.checkGuildConsistency(roleEvt.GuildID)
+	c.Guilds.LockKey(roleEvt.GuildID)
+	defer c.Guilds.UnlockKey(roleEvt.GuildID)
+
+	if guild, exists := c.getGuild(roleEvt.GuildID); exists {
+		for i, role := range guild.Roles {
+			if role != nil && role.ID == roleEvt.RoleID {
+				guild.Roles = append(guild.Roles[:i], guild.Roles[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return roleEvt, nil
+}
+
+// EvictGuilds is used to remove several guilds from the cache at once. Everything GuildDelete drops for a guild is dropped here too.
+// The guild lock is only acquired once for the whole batch.
+func (c *cache) EvictGuilds(ids []disgord.Snowflake) {
+	c.Guilds.Lock()
+	defer c.Guilds.Unlock()
+	for _, id := range ids {
+		c.destroyGuild(id)
+	}
+}
+
+func (c *cache) GetChannel(id disgord.Snowflake) (*disgord.Channel, error) {
+	c.ChannelMu.RLock()
+	res, ok := c.getChannel(id)
+	if !ok {
+		c.ChannelMu.RUnlock()
+		return nil, nil
+	}
+	cpy := res.DeepCopy().(*disgord.Channel)
+	c.ChannelMu.RUnlock()
+	return cpy, nil
+}
+
+// GetAllChannels is used to get copies of every channel in the cache, sorted by ID.
+// The channels are not revived, so enumerating them does not stop them from expiring.
+func (c *cache) GetAllChannels() ([]*disgord.Channel, error) {
+	c.ChannelMu.RLock()
+	defer c.ChannelMu.RUnlock()
+	keys := c.Channels.Keys()
+	channels := make([]*disgord.Channel, 0, len(keys))
+	for _, key := range keys {
+		if channel, ok := c.peekChannel(key.(disgord.Snowflake)); ok {
+			channels = append(channels, channel.DeepCopy().(*disgord.Channel))
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].ID < channels[j].ID
+	})
+	return channels, nil
+}
+
+// SetChannels is used to seed the channels of a guild, such as after fetching them over REST.
+// Any channels previously cached for the guild are replaced.
+func (c *cache) SetChannels(guildID disgord.Snowflake, channels []*disgord.Channel) {
+	c.ChannelMu.Lock()
+	defer c.ChannelMu.Unlock()
+	c.replaceGuildChannels(guildID, channels)
+}
+
+// SetChannel is used to seed a single channel, such as after fetching it over REST.
+// If the channel is already cached, only the non-zero fields are merged in so that anything learnt from the gateway is kept.
+func (c *cache) SetChannel(channel *disgord.Channel) {
+	if channel == nil {
+		return
+	}
+	channelCpy := channel.DeepCopy().(*disgord.Channel)
+
+	c.ChannelMu.Lock()
+	defer c.ChannelMu.Unlock()
+	existing, ok := c.getChannel(channelCpy.ID)
+	if !ok {
+		c.setChannel(channelCpy)
+		c.registerChannelRelationship(channelCpy.GuildID, channelCpy.ID)
+		c.registerDMRelationship(channelCpy, nil)
+		return
+	}
+	oldGuildId := existing.GuildID
+	mergeChannel(existing, channelCpy)
+	if oldGuildId != existing.GuildID {
+		c.destroyChannelRelationship(oldGuildId, existing.ID)
+		c.registerChannelRelationship(existing.GuildID, existing.ID)
+	}
+	c.registerDMRelationship(existing, nil)
+}
+
+// ValidateRelationships is used to check the guild channel relationships for inconsistencies.
+// An error is returned for every channel registered under more than one guild, or under a guild which does not match its guild ID.
+// This is intended for tests and debugging, and does not revive the channels.
+func (c *cache) ValidateRelationships() []error {
+	c.ChannelMu.RLock()
+	defer c.ChannelMu.RUnlock()
+
+	guildIds := make([]disgord.Snowflake, 0, len(c.GuildChannelRelationship))
+	for guildId := range c.GuildChannelRelationship {
+		guildIds = append(guildIds, guildId)
+	}
+	sort.Slice(guildIds, func(i, j int) bool {
+		return guildIds[i] < guildIds[j]
+	})
+
+	var errs []error
+	owners := map[disgord.Snowflake]disgord.Snowflake{}
+	for _, guildId := range guildIds {
+		for x := c.GuildChannelRelationship[guildId].Front(); x != nil; x = x.Next() {
+			channelId := x.Value.(disgord.Snowflake)
+			if owner, ok := owners[channelId]; ok {
+				errs = append(errs, fmt.Errorf("disgordtlru: channel %s is registered under guilds %s and %s", channelId, owner, guildId))
+			} else {
+				owners[channelId] = guildId
+			}
+			if channel, ok := c.peekChannel(channelId); ok && channel.GuildID != guildId {
+				errs = append(errs, fmt.Errorf("disgordtlru: channel %s is registered under guild %s but belongs to guild %s", channelId, guildId, channel.GuildID))
+			}
+		}
+	}
+	return errs
+}
+
+// SelfCheck is used to check the internal state of the cache for corruption, such as for a liveness probe.
+// The first problem found is returned, or nil if the cache is healthy. Only constant time checks are made and nothing is revived,
+// so this is cheap to call often. ValidateRelationships and DebugConsistencyChecks go through the cached state in full.
+func (c *cache) SelfCheck() error {
+	if c.Guilds == nil || c.Channels == nil || c.Users == nil || c.VoiceStates == nil {
+		return errors.New("disgordtlru: a store is missing")
+	}
+	stores := []*tlruCache{c.Guilds.tlruCache, c.Channels, c.Users.tlruCache, c.VoiceStates.tlruCache}
+	if c.Messages != nil {
+		stores = append(stores, c.Messages.tlruCache)
+	}
+	for _, store := range stores {
+		if store == nil {
+			return errors.New("disgordtlru: a store is missing")
+		}
+		if err := store.check(); err != nil {
+			return err
+		}
+	}
+
+	c.ChannelMu.RLock()
+	channelMapsOk := c.GuildChannelRelationship != nil && c.DMChannelRelationship != nil
+	c.ChannelMu.RUnlock()
+	c.VoiceStates.Lock()
+	voiceMapsOk := c.GuildVoiceStateRelationship != nil
+	c.VoiceStates.Unlock()
+	if !channelMapsOk || !voiceMapsOk {
+		return errors.New("disgordtlru: a relationship map is missing")
+	}
+	return nil
+}
+
+// Healthy is used to check if SelfCheck finds no problems with the cache.
+func (c *cache) Healthy() bool {
+	return c.SelfCheck() == nil
+}
+
+// GetChannelParent is used to get the parent category of a channel.
+// Nil is returned for top level channels or if the parent is not cached.
+func (c *cache) GetChannelParent(channelID disgord.Snowflake) (*disgord.Channel, error) {
+	c.ChannelMu.RLock()
+	defer c.ChannelMu.RUnlock()
+	res, ok := c.getChannel(channelID)
+	if !ok || res.ParentID.IsZero() {
+		return nil, nil
+	}
+	parent, ok := c.getChannel(res.ParentID)
+	if !ok {
+		return nil, nil
+	}
+	return parent.DeepCopy().(*disgord.Channel), nil
+}
+
+// GetChannelSlowmode is used to get the slowmode (rate limit per user) of a channel in seconds.
+func (c *cache) GetChannelSlowmode(channelID disgord.Snowflake) (int, bool) {
+	c.ChannelMu.RLock()
+	defer c.ChannelMu.RUnlock()
+	res, ok := c.getChannel(channelID)
+	if !ok {
+		return 0, false
+	}
+	return int(res.RateLimitPerUser), true
+}
+
+// GetChannelOverwriteFor is used to get the permission overwrite a channel has for a role or member.
+func (c *cache) GetChannelOverwriteFor(channelID, targetID disgord.Snowflake) (*disgord.PermissionOverwrite, error) {
+	c.ChannelMu.RLock()
+	defer c.ChannelMu.RUnlock()
+	res, ok := c.getChannel(channelID)
+	if !ok {
+		return nil, nil
+	}
+	for _, overwrite := range res.PermissionOverwrites {
+		if overwrite.ID == targetID {
+			cpy := overwrite
+			return &cpy, nil
+		}
+	}
+	return nil, nil
+}
+
+// IsChannelNSFW is used to check if a channel is marked as NSFW.
+func (c *cache) IsChannelNSFW(channelID disgord.Snowflake) (bool, bool) {
+	c.ChannelMu.RLock()
+	defer c.ChannelMu.RUnlock()
+	res, ok := c.getChannel(channelID)
+	if !ok {
+		return false, false
+	}
+	return res.NSFW, true
+}
+
+// GetChannelRecipients is used to get the recipients of a cached DM or group DM channel.
+// Nil is returned for any other type of channel or if the channel is not cached.
+func (c *cache) GetChannelRecipients(channelID disgord.Snowflake) ([]*disgord.User, error) {
+	c.ChannelMu.RLock()
+	defer c.ChannelMu.RUnlock()
+	res, ok := c.getChannel(channelID)
+	if !ok || (res.Type != disgord.ChannelTypeDM && res.Type != disgord.ChannelTypeGroupDM) {
+		return nil, nil
+	}
+	recipients := make([]*disgord.User, 0, len(res.Recipients))
+	for _, recipient := range res.Recipients {
+		if recipient != nil {
+			recipients = append(recipients, recipient.DeepCopy().(*disgord.User))
+		}
+	}
+	return recipients, nil
+}
+
+// GetDMChannelForUser is used to get the cached DM channel with a user.
+func (c *cache) GetDMChannelForUser(userID disgord.Snowflake) (*disgord.Channel, error) {
+	c.ChannelMu.RLock()
+	defer c.ChannelMu.RUnlock()
+	channelID, ok := c.DMChannelRelationship[userID]
+	if !ok {
+		return nil, nil
+	}
+	res, ok := c.getChannel(channelID)
+	if !ok {
+		return nil, nil
+	}
+	return res.DeepCopy().(*disgord.Channel), nil
+}
+
+func (c *cache) GetGuildEmoji(guildID, emojiID disgord.Snowflake) (*disgord.Emoji, error) {
+	c.Guilds.LockKey(guildID)
+	defer c.Guilds.UnlockKey(guildID)
+	guild, ok := c.getGuild(guildID)
+	if !ok {
+		return nil, nil
+	}
+	for _, emoji := range guild.Emojis {
+		if emoji != nil && emoji.ID == emojiID {
+			return emoji.DeepCopy().(*disgord.Emoji), nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *cache) GetGuildEmojis(id disgord.Snowflake) ([]*disgord.Emoji, error) {
+	c.Guilds.LockKey(id)
+	defer c.Guilds.UnlockKey(id)
+	guild, ok := c.getGuild(id)
+	if !ok {
+		return nil, nil
+	}
+	return copyEmojis(guild.Emojis), nil
+}
+
+// GetGuildEmojisOk is used to get the emojis of a guild, always returning a non-nil slice.
+// The boolean is false if the guild is not cached.
+func (c *cache) GetGuildEmojisOk(id disgord.Snowflake) ([]*disgord.Emoji, bool) {
+	c.Guilds.LockKey(id)
+	defer c.Guilds.UnlockKey(id)
+	guild, ok := c.getGuild(id)
+	if !ok {
+		return []*disgord.Emoji{}, false
+	}
+	return copyEmojis(guild.Emojis), true
+}
+
+func (c *cache) GetGuild(id disgord.Snowflake) (*disgord.Guild, error) {
+	// Make a copy of the guild.
+	c.Guilds.LockKey(id)
+	res, ok := c.getGuild(id)
+	if !ok {
+		c.Guilds.UnlockKey(id)
+		return nil, nil
+	}
+	cpy := c.copyGuild(res)
+	c.Guilds.UnlockKey(id)
+
+	// Get the channels.
+	channelsRes, _ := c.GetGuildChannels(id)
+	if channelsRes != nil {
+		cpy.Channels = channelsRes
+	}
+
+	// Return the copy.
+	return cpy, nil
+}
+
+// GetGuilds is used to get several guilds at once. Guilds which are not cached are left out of the map.
+// The guild lock is only acquired once for the whole batch.
+func (c *cache) GetGuilds(ids []disgord.Snowflake) (map[disgord.Snowflake]*disgord.Guild, error) {
+	guilds := make(map[disgord.Snowflake]*disgord.Guild, len(ids))
+	c.Guilds.Lock()
+	for _, id := range ids {
+		if res, ok := c.getGuild(id); ok {
+			guilds[id] = c.copyGuild(res)
+		}
+	}
+	c.Guilds.Unlock()
+
+	// Get the channels.
+	c.ChannelMu.RLock()
+	defer c.ChannelMu.RUnlock()
+	for id, guild := range guilds {
+		if channels := c.copyGuildChannels(id, c.getChannel); channels != nil {
+			guild.Channels = channels
+		}
+	}
+	return guilds, nil
+}
+
+// GetAllGuilds is used to get copies of every guild in the cache, sorted by ID.
+// Like GetGuild, members are only included if ReturnGetGuildMembers is set. The guilds are not revived, so enumerating them does
+// not stop them from expiring.
+func (c *cache) GetAllGuilds() ([]*disgord.Guild, error) {
+	return c.getGuildsWhere(nil), nil
+}
+
+// GetGuildsByFeature is used to get copies of every cached guild which has the feature given (for example "COMMUNITY").
+// This works like GetAllGuilds, so the guilds are sorted by ID and are not revived.
+func (c *cache) GetGuildsByFeature(feature string) ([]*disgord.Guild, error) {
+	return c.getGuildsWhere(func(guild *disgord.Guild) bool {
+		for _, v := range guild.Features {
+			if v == feature {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+// Used to get copies of the cached guilds which match the predicate given, sorted by ID and without reviving them.
+// A nil predicate matches every guild.
+func (c *cache) getGuildsWhere(pred func(*disgord.Guild) bool) []*disgord.Guild {
+	c.Guilds.Lock()
+	keys := c.Guilds.Keys()
+	guilds := make([]*disgord.Guild, 0, len(keys))
+	for _, key := range keys {
+		if res, ok := c.peekGuild(key.(disgord.Snowflake)); ok && (pred == nil || pred(res)) {
+			guilds = append(guilds, c.copyGuild(res))
+		}
+	}
+	c.Guilds.Unlock()
+	sort.Slice(guilds, func(i, j int) bool {
+		return guilds[i].ID < guilds[j].ID
+	})
+
+	// Get the channels.
+	c.ChannelMu.RLock()
+	defer c.ChannelMu.RUnlock()
+	for _, guild := range guilds {
+		if channels := c.copyGuildChannels(guild.ID, c.peekChannel); channels != nil {
+			guild.Channels = channels
+		}
+	}
+	return guilds
+}
+
+// ViewGuild is used to run a function against the live cached guild under the guild lock.
+// This gives a consistent view of the guild without making any copies. The guild MUST NOT be mutated or kept
+// after the function returns, and the function MUST NOT call back into the cache since the lock is not reentrant.
+// If the guild is not cached, the function is not called and nil is returned.
+func (c *cache) ViewGuild(guildID disgord.Snowflake, fn func(*disgord.Guild) error) error {
+	c.Guilds.LockKey(guildID)
+	defer c.Guilds.UnlockKey(guildID)
+	guild, ok := c.getGuild(guildID)
+	if !ok {
+		return nil
+	}
+	return fn(guild)
+}
+
+// GetGuildWidget is used to get the widget settings of a cached guild.
+func (c *cache) GetGuildWidget(guildID disgord.Snowflake) (enabled bool, channelID disgord.Snowflake, ok bool) {
+	c.Guilds.LockKey(guildID)
+	defer c.Guilds.UnlockKey(guildID)
+	guild, ok := c.getGuild(guildID)
+	if !ok {
+		return false, 0, false
+	}
+	return guild.WidgetEnabled, guild.WidgetChannelID, true
+}
+
+// GetVoiceServer is used to get the latest voice server update for a guild.
+// This requires StoreVoiceServers to be set in the config.
+func (c *cache) GetVoiceServer(guildID disgord.Snowflake) (*disgord.VoiceServerUpdate, bool) {
+	c.VoiceServerMu.Lock()
+	defer c.VoiceServerMu.Unlock()
+	vsu, ok := c.VoiceServers[guildID]
+	if !ok {
+		return nil, false
+	}
+	return &disgord.VoiceServerUpdate{Token: vsu.Token, GuildID: vsu.GuildID, Endpoint: vsu.Endpoint}, true
+}
+
+// GetGuildCreatedAt is used to get the creation time of a cached guild from its snowflake.
+func (c *cache) GetGuildCreatedAt(guildID disgord.Snowflake) (time.Time, bool) {
+	// This only checks that the guild is cached, so it is not revived.
+	c.Guilds.LockKey(guildID)
+	_, ok := c.Guilds.Peek(guildID)
+	c.observeGet(storeGuild, ok)
+	c.Guilds.UnlockKey(guildID)
+	if !ok {
+		return time.Time{}, false
+	}
+	return snowflakeTime(guildID), true
+}
+
+// GetGuildBotJoinedAt is used to get the time the bot joined a cached guild.
+// False is returned if the guild is not cached or the guild create did not carry the join time.
+func (c *cache) GetGuildBotJoinedAt(guildID disgord.Snowflake) (time.Time, bool) {
+	c.Guilds.LockKey(guildID)
+	defer c.Guilds.UnlockKey(guildID)
+	guild, ok := c.getGuild(guildID)
+	if !ok || guild.JoinedAt == nil {
+		return time.Time{}, false
+	}
+	return guild.JoinedAt.Time, true
+}
+
+// GuildLastEventTime is used to get the time of the last guild scoped event received for a guild.
+// This is useful for finding quiet guilds or guilds whose events have stopped flowing. Only cached guilds are tracked.
+func (c *cache) GuildLastEventTime(guildID disgord.Snowflake) (time.Time, bool) {
+	c.LastEventMu.Lock()
+	defer c.LastEventMu.Unlock()
+	t, ok := c.LastEvent[guildID]
+	return t, ok
+}
+
+// GuildFreshness is used to get how long a cached guild has left before it expires, without reviving it.
+// This lets read-through callers refresh guilds which are about to expire. False is returned if the guild is not cached.
+func (c *cache) GuildFreshness(guildID disgord.Snowflake) (time.Duration, bool) {
+	expires, ok := c.Guilds.Expires(guildID)
+	if !ok {
+		return 0, false
+	}
+	return expires.Sub(c.now()), true
+}
+
+func (c *cache) GetGuildChannels(id disgord.Snowflake) ([]*disgord.Channel, error) {
+	c.ChannelMu.RLock()
+	defer c.ChannelMu.RUnlock()
+	return c.copyGuildChannels(id, c.getChannel), nil
+}
+
+// Used to copy the cached channels of a guild, looking each of them up with get. Returns nil if the guild has no channel relationships.
+// THIS FUNCTION EXPECTS THE CHANNEL LOCK TO BE HELD!
+func (c *cache) copyGuildChannels(guildId disgord.Snowflake, get func(disgord.Snowflake) (*disgord.Channel, bool)) []*disgord.Channel {
+	relationships, ok := c.GuildChannelRelationship[guildId]
+	if !ok {
+		return nil
+	}
+	channels := make([]*disgord.Channel, 0, relationships.Len())
+	for x := relationships.Front(); x != nil; x = x.Next() {
+		if channel, ok := get(x.Value.(disgord.Snowflake)); ok {
+			channels = append(channels, channel.DeepCopy().(*disgord.Channel))
+		}
+	}
+	return channels
+}
+
+// GetGuildChannelByName is used to get a channel of a guild by its name.
+// If several channels share the name, the one with the lowest position is returned, falling back to the lowest ID.
+func (c *cache) GetGuildChannelByName(guildID disgord.Snowflake, name string) (*disgord.Channel, error) {
+	c.ChannelMu.RLock()
+	defer c.ChannelMu.RUnlock()
+	relationships, ok := c.GuildChannelRelationship[guildID]
+	if !ok {
+		return nil, nil
+	}
+	var res *disgord.Channel
+	for x := relationships.Front(); x != nil; x = x.Next() {
+		channel, ok := c.getChannel(x.Value.(disgord.Snowflake))
+		if !ok || channel.Name != name {
+			continue
+		}
+		if res == nil || channel.Position < res.Position || (channel.Position == res.Position && channel.ID < res.ID) {
+			res = channel
+		}
+	}
+	if res == nil {
+		return nil, nil
+	}
+	return res.DeepCopy().(*disgord.Channel), nil
+}
+
+// ChannelNode is used to represent a category and the channels within it.
+// For uncategorized channels, Channel is nil.
+type ChannelNode struct {
+	Channel  *disgord.Channel
+	Children []*disgord.Channel
+}
+
+// Used to sort snowflakes in ascending order so that results built from maps are stable.
+func sortSnowflakes(ids []disgord.Snowflake) {
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+}
+
+// Used to sort channels by position, falling back to the ID.
+func sortChannels(channels []*disgord.Channel) {
+	sort.Slice(channels, func(i, j int) bool {
+		if channels[i].Position != channels[j].Position {
+			return channels[i].Position < channels[j].Position
+		}
+		return channels[i].ID < channels[j].ID
+	})
+}
+
+// GetGuildChannelTree is used to get the channels of a guild grouped by category.
+// The first node holds the uncategorized channels and the categories follow in position order.
+func (c *cache) GetGuildChannelTree(guildID disgord.Snowflake) ([]*ChannelNode, error) {
+	c.ChannelMu.RLock()
+	defer c.ChannelMu.RUnlock()
+	relationships, ok := c.GuildChannelRelationship[guildID]
+	if !ok {
+		return nil, nil
+	}
+
+	uncategorized := &ChannelNode{}
+	categories := map[disgord.Snowflake]*ChannelNode{}
+	for x := relationships.Front(); x != nil; x = x.Next() {
+		channel, ok := c.getChannel(x.Value.(disgord.Snowflake))
+		if ok && channel.Type == disgord.ChannelTypeGuildCategory {
+			categories[channel.ID] = &ChannelNode{Channel: channel.DeepCopy().(*disgord.Channel)}
+		}
+	}
+	for x := relationships.Front(); x != nil; x = x.Next() {
+		channel, ok := c.getChannel(x.Value.(disgord.Snowflake))
+		if !ok || channel.Type == disgord.ChannelTypeGuildCategory {
+			continue
+		}
+		node, ok := categories[channel.ParentID]
+		if !ok {
+			// Channels pointing at a category we do not know about are treated as uncategorized.
+			node = uncategorized
+		}
+		node.Children = append(node.Children, channel.DeepCopy().(*disgord.Channel))
+	}
+
+	categoryChannels := make([]*disgord.Channel, 0, len(categories))
+	for _, node := range categories {
+		categoryChannels = append(categoryChannels, node.Channel)
+	}
+	sortChannels(categoryChannels)
+	nodes := make([]*ChannelNode, 0, len(categories)+1)
+	sortChannels(uncategorized.Children)
+	nodes = append(nodes, uncategorized)
+	for _, category := range categoryChannels {
+		node := categories[category.ID]
+		sortChannels(node.Children)
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// GetGuildChannelPositions is used to get a map of channel ID to position for the channels of a guild.
+func (c *cache) GetGuildChannelPositions(guildID disgord.Snowflake) (map[disgord.Snowflake]int, error) {
+	c.ChannelMu.RLock()
 	defer c.ChannelMu.RUnlock()
-	relationships, ok := c.GuildChannelRelationship[id]
+	relationships, ok := c.GuildChannelRelationship[guildID]
 	if !ok {
 		return nil, nil
 	}
-	channels := make([]*disgord.Channel, relationships.Len())
-	i := 0
+	positions := make(map[disgord.Snowflake]int, relationships.Len())
 	for x := relationships.Front(); x != nil; x = x.Next() {
-		channels[i] = c.Channels[x.Value.(disgord.Snowflake)].DeepCopy().(*disgord.Channel)
-		i++
+		if channel, ok := c.getChannel(x.Value.(disgord.Snowflake)); ok {
+			positions[channel.ID] = channel.Position
+		}
 	}
-	return channels, nil
+	return positions, nil
 }
 
 func (c *cache) GetMember(guildID, userID disgord.Snowflake) (*disgord.Member, error) {
-	c.Guilds.Lock()
-	defer c.Guilds.Unlock()
-	guild, ok := c.Guilds.Get(guildID)
+	c.Guilds.LockKey(guildID)
+	defer c.Guilds.UnlockKey(guildID)
+	entry, ok := c.getCachedGuild(guildID)
+	if !ok {
+		return nil, nil
+	}
+	member := entry.member(userID)
+	if member == nil {
+		return nil, nil
+	}
+	return copyMember(member), nil
+}
+
+// GetMemberJoinedAt is used to get the time a cached member joined the guild.
+func (c *cache) GetMemberJoinedAt(guildID, userID disgord.Snowflake) (time.Time, bool) {
+	c.Guilds.LockKey(guildID)
+	defer c.Guilds.UnlockKey(guildID)
+	entry, ok := c.getCachedGuild(guildID)
+	if !ok {
+		return time.Time{}, false
+	}
+	member := entry.member(userID)
+	if member == nil {
+		return time.Time{}, false
+	}
+	return member.JoinedAt.Time, true
+}
+
+// GetMembersPaginated is used to get a page of loaded members ordered by user ID.
+// Only members with a user ID greater than after are returned, up to limit members. A limit of 0 or less returns all of them.
+func (c *cache) GetMembersPaginated(guildID, after disgord.Snowflake, limit int) ([]*disgord.Member, error) {
+	c.Guilds.LockKey(guildID)
+	defer c.Guilds.UnlockKey(guildID)
+	guild, ok := c.getGuild(guildID)
 	if !ok {
 		return nil, nil
 	}
-	for _, member := range guild.(*disgord.Guild).Members {
-		if member.UserID == userID {
-			return member, nil
+	page := make([]*disgord.Member, 0)
+	for _, member := range guild.Members {
+		if member.UserID > after {
+			page = append(page, member)
 		}
 	}
-	return nil, nil
+	sort.Slice(page, func(i, j int) bool {
+		return page[i].UserID < page[j].UserID
+	})
+	if limit > 0 && len(page) > limit {
+		page = page[:limit]
+	}
+	for i, member := range page {
+		page[i] = copyMember(member)
+	}
+	return page, nil
+}
+
+// ForEachMember is used to iterate the loaded members of a guild without copying them.
+// The function is called with the cached member under the guild lock, so it must not mutate it or call back into the cache.
+// Iteration stops when the function returns false.
+func (c *cache) ForEachMember(guildID disgord.Snowflake, fn func(*disgord.Member) bool) error {
+	c.Guilds.LockKey(guildID)
+	defer c.Guilds.UnlockKey(guildID)
+	guild, ok := c.getGuild(guildID)
+	if !ok {
+		return nil
+	}
+	for _, member := range guild.Members {
+		if !fn(member) {
+			break
+		}
+	}
+	return nil
+}
+
+// GetGuildMemberIDs is used to get the user ID's of the loaded members of a guild without copying the members.
+// The ID's are sorted in ascending order.
+func (c *cache) GetGuildMemberIDs(guildID disgord.Snowflake) ([]disgord.Snowflake, error) {
+	c.Guilds.LockKey(guildID)
+	defer c.Guilds.UnlockKey(guildID)
+	guild, ok := c.getGuild(guildID)
+	if !ok {
+		return nil, nil
+	}
+	members := guild.Members
+	ids := make([]disgord.Snowflake, 0, len(members))
+	for _, member := range members {
+		ids = append(ids, member.UserID)
+	}
+	sortSnowflakes(ids)
+	return ids, nil
+}
+
+// CountMembers is used to count the loaded members of a guild which match the predicate.
+// The predicate is called with the cached member under the guild lock, so it must not mutate it or call back into the cache.
+func (c *cache) CountMembers(guildID disgord.Snowflake, pred func(*disgord.Member) bool) (int, error) {
+	c.Guilds.LockKey(guildID)
+	defer c.Guilds.UnlockKey(guildID)
+	guild, ok := c.getGuild(guildID)
+	if !ok {
+		return 0, nil
+	}
+	count := 0
+	for _, member := range guild.Members {
+		if pred(member) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// GetGuildRole is used to get a single role of a guild.
+func (c *cache) GetGuildRole(guildID, roleID disgord.Snowflake) (*disgord.Role, error) {
+	c.Guilds.LockKey(guildID)
+	defer c.Guilds.UnlockKey(guildID)
+	guild, ok := c.getGuild(guildID)
+	if !ok {
+		return nil, nil
+	}
+	role := findRole(guild, roleID)
+	if role == nil {
+		return nil, nil
+	}
+	return role.DeepCopy().(*disgord.Role), nil
 }
 
 func (c *cache) GetGuildRoles(guildID disgord.Snowflake) ([]*disgord.Role, error) {
-	c.Guilds.Lock()
-	defer c.Guilds.Unlock()
-	guild, ok := c.Guilds.Get(guildID)
+	c.Guilds.LockKey(guildID)
+	defer c.Guilds.UnlockKey(guildID)
+	guild, ok := c.getGuild(guildID)
+	if !ok {
+		return nil, nil
+	}
+	return copyRoles(guild.Roles), nil
+}
+
+// GetGuildRolesSorted is used to get the roles of a guild in hierarchy order.
+// Roles are sorted by position descending, and then by ID ascending for ties (the order Discord uses).
+func (c *cache) GetGuildRolesSorted(guildID disgord.Snowflake) ([]*disgord.Role, error) {
+	c.Guilds.LockKey(guildID)
+	guild, ok := c.getGuild(guildID)
+	if !ok {
+		c.Guilds.UnlockKey(guildID)
+		return nil, nil
+	}
+	roles := copyRoles(guild.Roles)
+	c.Guilds.UnlockKey(guildID)
+
+	sort.Slice(roles, func(i, j int) bool {
+		return roleIsHigher(roles[i], roles[j])
+	})
+	return roles, nil
+}
+
+// GetMemberRoles is used to get the roles of a member resolved against the guild roles.
+// Role ID's which are not in the guild role set are skipped.
+func (c *cache) GetMemberRoles(guildID, userID disgord.Snowflake) ([]*disgord.Role, error) {
+	c.Guilds.LockKey(guildID)
+	defer c.Guilds.UnlockKey(guildID)
+	entry, ok := c.getCachedGuild(guildID)
 	if !ok {
 		return nil, nil
 	}
-	a := make([]*disgord.Role, len(guild.(*disgord.Guild).Emojis))
-	for i, role := range guild.(*disgord.Guild).Roles {
-		a[i] = role.DeepCopy().(*disgord.Role)
+	member := entry.member(userID)
+	if member == nil {
+		return nil, nil
+	}
+	guild := entry.Guild
+	a := make([]*disgord.Role, 0, len(member.Roles))
+	for _, roleID := range member.Roles {
+		if role := findRole(guild, roleID); role != nil {
+			a = append(a, role.DeepCopy().(*disgord.Role))
+		}
 	}
 	return a, nil
 }
 
+// GetGuildRoleByPosition is used to get the role at a position within a guild.
+// If several roles share the position, the one Discord orders highest is returned.
+func (c *cache) GetGuildRoleByPosition(guildID disgord.Snowflake, position int) (*disgord.Role, error) {
+	c.Guilds.LockKey(guildID)
+	defer c.Guilds.UnlockKey(guildID)
+	guild, ok := c.getGuild(guildID)
+	if !ok {
+		return nil, nil
+	}
+	var res *disgord.Role
+	for _, role := range guild.Roles {
+		if role != nil && role.Position == position && (res == nil || roleIsHigher(role, res)) {
+			res = role
+		}
+	}
+	if res == nil {
+		return nil, nil
+	}
+	return res.DeepCopy().(*disgord.Role), nil
+}
+
+// GetMemberHighestRole is used to get the highest positioned role of a member.
+// If the member has no other roles, the @everyone role is returned.
+func (c *cache) GetMemberHighestRole(guildID, userID disgord.Snowflake) (*disgord.Role, error) {
+	c.Guilds.LockKey(guildID)
+	defer c.Guilds.UnlockKey(guildID)
+	entry, ok := c.getCachedGuild(guildID)
+	if !ok {
+		return nil, nil
+	}
+	member := entry.member(userID)
+	if member == nil {
+		return nil, nil
+	}
+	guild := entry.Guild
+	var highest *disgord.Role
+	for _, roleID := range member.Roles {
+		role := findRole(guild, roleID)
+		if role != nil && (highest == nil || roleIsHigher(role, highest)) {
+			highest = role
+		}
+	}
+	if highest == nil {
+		// The @everyone role shares the ID of the guild.
+		highest = findRole(guild, guildID)
+		if highest == nil {
+			return nil, nil
+		}
+	}
+	return highest.DeepCopy().(*disgord.Role), nil
+}
+
 func (c *cache) GetCurrentUser() (*disgord.User, error) {
 	c.CurrentUserMu.Lock()
 	var cpy *disgord.User
@@ -490,6 +2914,7 @@ func (c *cache) GetCurrentUser() (*disgord.User, error) {
 func (c *cache) GetUser(id disgord.Snowflake) (*disgord.User, error) {
 	c.Users.Lock()
 	res, ok := c.Users.Get(id)
+	c.observeGet(storeUser, ok)
 	if !ok {
 		c.Users.Unlock()
 		return nil, nil
@@ -499,10 +2924,445 @@ func (c *cache) GetUser(id disgord.Snowflake) (*disgord.User, error) {
 	return cpy, nil
 }
 
+// GetUserFlags is used to get the public flags of a cached user.
+func (c *cache) GetUserFlags(userID disgord.Snowflake) (disgord.UserFlag, bool) {
+	c.Users.Lock()
+	defer c.Users.Unlock()
+	res, ok := c.Users.Get(userID)
+	c.observeGet(storeUser, ok)
+	if !ok {
+		return 0, false
+	}
+	return res.(*disgord.User).PublicFlags, true
+}
+
+// UserIDs is used to get the ID's of every user in the cache, sorted in ascending order. The users are not revived.
+func (c *cache) UserIDs() []disgord.Snowflake {
+	c.Users.Lock()
+	keys := c.Users.Keys()
+	c.Users.Unlock()
+	ids := make([]disgord.Snowflake, len(keys))
+	for i, key := range keys {
+		ids[i] = key.(disgord.Snowflake)
+	}
+	sortSnowflakes(ids)
+	return ids
+}
+
+// GetVoiceChannelUserIDs is used to get the ID's of the users connected to a voice channel.
+// This avoids copying the voice states when only the users are needed. The ID's are sorted in ascending order.
+func (c *cache) GetVoiceChannelUserIDs(guildID, channelID disgord.Snowflake) ([]disgord.Snowflake, error) {
+	c.VoiceStates.Lock()
+	defer c.VoiceStates.Unlock()
+	users, ok := c.GuildVoiceStateRelationship[guildID]
+	if !ok {
+		return nil, nil
+	}
+	ids := make([]disgord.Snowflake, 0)
+	for userID := range users {
+		item, exists := c.VoiceStates.Get(voiceStateKey{GuildID: guildID, UserID: userID})
+		c.observeGet(storeVoiceState, exists)
+		if exists && item.(*disgord.VoiceState).ChannelID == channelID {
+			ids = append(ids, userID)
+		}
+	}
+	sortSnowflakes(ids)
+	return ids, nil
+}
+
+// GetVoiceState is used to get the cached voice state of a user within a guild.
+func (c *cache) GetVoiceState(guildID, userID disgord.Snowflake) (*disgord.VoiceState, error) {
+	c.VoiceStates.Lock()
+	defer c.VoiceStates.Unlock()
+	item, ok := c.VoiceStates.Get(voiceStateKey{GuildID: guildID, UserID: userID})
+	c.observeGet(storeVoiceState, ok)
+	if !ok {
+		return nil, nil
+	}
+	return item.(*disgord.VoiceState).DeepCopy().(*disgord.VoiceState), nil
+}
+
+// GetGuildVoiceStates is used to get all of the cached voice states within a guild, sorted by user ID.
+func (c *cache) GetGuildVoiceStates(guildID disgord.Snowflake) ([]*disgord.VoiceState, error) {
+	c.VoiceStates.Lock()
+	defer c.VoiceStates.Unlock()
+	users, ok := c.GuildVoiceStateRelationship[guildID]
+	if !ok {
+		return nil, nil
+	}
+	states := make([]*disgord.VoiceState, 0, len(users))
+	for userID := range users {
+		item, exists := c.VoiceStates.Get(voiceStateKey{GuildID: guildID, UserID: userID})
+		c.observeGet(storeVoiceState, exists)
+		if exists {
+			states = append(states, item.(*disgord.VoiceState).DeepCopy().(*disgord.VoiceState))
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].UserID < states[j].UserID
+	})
+	return states, nil
+}
+
+// Used to count the voice states cached for a guild without reviving them.
+// THIS FUNCTION EXPECTS THE VOICE STATE LOCK TO BE HELD!
+func (c *cache) countGuildVoiceStates(guildId disgord.Snowflake) int {
+	count := 0
+	for userId := range c.GuildVoiceStateRelationship[guildId] {
+		// Expired voice states are still referenced until the TLRU purges them.
+		if _, exists := c.VoiceStates.Peek(voiceStateKey{GuildID: guildId, UserID: userId}); exists {
+			count++
+		}
+	}
+	return count
+}
+
+// VoiceStateCount is used to get the amount of voice states cached across all guilds without copying them.
+func (c *cache) VoiceStateCount() int {
+	c.VoiceStates.Lock()
+	defer c.VoiceStates.Unlock()
+	count := 0
+	for guildID := range c.GuildVoiceStateRelationship {
+		count += c.countGuildVoiceStates(guildID)
+	}
+	return count
+}
+
+// GuildVoiceStateCount is used to get the amount of voice states cached for a guild without copying them.
+// False is returned if the guild has no cached voice states.
+func (c *cache) GuildVoiceStateCount(guildID disgord.Snowflake) (int, bool) {
+	c.VoiceStates.Lock()
+	defer c.VoiceStates.Unlock()
+	count := c.countGuildVoiceStates(guildID)
+	return count, count != 0
+}
+
+// GetMessage is used to get a cached message. This requires message caching to be turned on in the config.
+func (c *cache) GetMessage(channelID, messageID disgord.Snowflake) (*disgord.Message, error) {
+	if c.Messages == nil {
+		return nil, nil
+	}
+	c.Messages.Lock()
+	defer c.Messages.Unlock()
+	item, ok := c.Messages.Get(messageKey{ChannelID: channelID, MessageID: messageID})
+	c.observeGet(storeMessage, ok)
+	if !ok {
+		return nil, nil
+	}
+	return copyMessage(item.(*disgord.Message)), nil
+}
+
+// GetChannelMessages is used to get the most recent cached messages of a channel, newest first.
+// A limit of zero or less returns every cached message. This requires message caching to be turned on in the config.
+func (c *cache) GetChannelMessages(channelID disgord.Snowflake, limit int) ([]*disgord.Message, error) {
+	if c.Messages == nil {
+		return nil, nil
+	}
+	c.Messages.Lock()
+	defer c.Messages.Unlock()
+
+	// Snowflakes are ordered by creation time, so the newest messages are at the end.
+	ids := c.ChannelMessageRelationship[channelID]
+	var messages []*disgord.Message
+	for i := len(ids) - 1; i >= 0; i-- {
+		if limit > 0 && len(messages) == limit {
+			break
+		}
+		item, ok := c.Messages.Get(messageKey{ChannelID: channelID, MessageID: ids[i]})
+		c.observeGet(storeMessage, ok)
+		if ok {
+			messages = append(messages, copyMessage(item.(*disgord.Message)))
+		}
+	}
+	return messages, nil
+}
+
+// The current version of the snapshot format. This is bumped whenever the format changes incompatibly.
+const snapshotVersion = 1
+
+// Defines the serialized form of the cache used by Snapshot and Restore.
+type cacheSnapshot struct {
+	Version     int                   `json:"version"`
+	CurrentUser *disgord.User         `json:"current_user"`
+	Guilds      []*disgord.Guild      `json:"guilds"`
+	Channels    []*disgord.Channel    `json:"channels"`
+	Users       []*disgord.User       `json:"users"`
+	VoiceStates []*disgord.VoiceState `json:"voice_states"`
+}
+
+// Snapshot is used to serialize the cached guilds, channels, users and voice states along with the current user.
+// Messages, voice servers and the TLRU expiry times are not included, and taking a snapshot does not revive anything.
+// Each entry is copied under a brief lock of its own and everything is serialized after the locks are released, so the cache
+// can still be read and updated while a large snapshot is taken. This means each entry is consistent, but entries changed
+// during the snapshot may be from either side of the change. See Restore for loading the snapshot.
+func (c *cache) Snapshot() ([]byte, error) {
+	snapshot := cacheSnapshot{Version: snapshotVersion}
+
+	c.CurrentUserMu.Lock()
+	snapshot.CurrentUser = c.CurrentUser.DeepCopy().(*disgord.User)
+	c.CurrentUserMu.Unlock()
+
+	// The keys are taken from the TLRUs without their locks since the TLRUs have their own mutexes.
+	for _, key := range c.Guilds.Keys() {
+		if guild := c.snapshotGuild(key.(disgord.Snowflake)); guild != nil {
+			snapshot.Guilds = append(snapshot.Guilds, guild)
+		}
+	}
+
+	for _, key := range c.Channels.Keys() {
+		c.ChannelMu.RLock()
+		if channel, ok := c.peekChannel(key.(disgord.Snowflake)); ok {
+			snapshot.Channels = append(snapshot.Channels, channel.DeepCopy().(*disgord.Channel))
+		}
+		c.ChannelMu.RUnlock()
+	}
+
+	for _, key := range c.Users.Keys() {
+		c.Users.Lock()
+		if item, ok := c.Users.Peek(key); ok {
+			snapshot.Users = append(snapshot.Users, item.(*disgord.User).DeepCopy().(*disgord.User))
+		}
+		c.Users.Unlock()
+	}
+
+	for _, key := range c.VoiceStates.Keys() {
+		c.VoiceStates.Lock()
+		if item, ok := c.VoiceStates.Peek(key); ok {
+			snapshot.VoiceStates = append(snapshot.VoiceStates, item.(*disgord.VoiceState).DeepCopy().(*disgord.VoiceState))
+		}
+		c.VoiceStates.Unlock()
+	}
+
+	return json.Marshal(&snapshot)
+}
+
+// Used to copy a guild for a snapshot under its own guild lock, including the members. Nil is returned if the guild is not cached.
+func (c *cache) snapshotGuild(guildID disgord.Snowflake) *disgord.Guild {
+	c.Guilds.LockKey(guildID)
+	defer c.Guilds.UnlockKey(guildID)
+	guild, ok := c.peekGuild(guildID)
+	if !ok {
+		return nil
+	}
+	cpy := copyGuildWithoutMembers(guild)
+	cpy.Members = copyMembers(guild.Members)
+	// The channels are snapshotted from the channel store instead.
+	cpy.Channels = nil
+	return cpy
+}
+
+// Restore is used to replace the contents of the cache with a snapshot made by Snapshot.
+// The relationships are rebuilt from the restored channels and voice states, and every entry gets the configured TLRU duration afresh.
+func (c *cache) Restore(data []byte) error {
+	defer c.reportEvictions()
+	var snapshot cacheSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	if snapshot.Version != snapshotVersion {
+		return fmt.Errorf("disgordtlru: unsupported snapshot version %d", snapshot.Version)
+	}
+
+	c.Clear()
+
+	if snapshot.CurrentUser != nil {
+		c.CurrentUserMu.Lock()
+		*c.CurrentUser = *snapshot.CurrentUser
+		c.CurrentUserMu.Unlock()
+	}
+
+	for _, guild := range snapshot.Guilds {
+		if guild == nil {
+			continue
+		}
+		guild.Channels = nil
+		c.Guilds.LockKey(guild.ID)
+		c.setGuild(guild)
+		c.Guilds.UnlockKey(guild.ID)
+	}
+
+	c.ChannelMu.Lock()
+	for _, channel := range snapshot.Channels {
+		if channel == nil {
+			continue
+		}
+		c.setChannel(channel)
+		c.registerChannelRelationship(channel.GuildID, channel.ID)
+		c.registerDMRelationship(channel, nil)
+	}
+	c.ChannelMu.Unlock()
+
+	c.Users.Lock()
+	for _, user := range snapshot.Users {
+		if user != nil {
+			c.setUser(user)
+		}
+	}
+	c.Users.Unlock()
+
+	c.VoiceStates.Lock()
+	for _, state := range snapshot.VoiceStates {
+		if state == nil {
+			continue
+		}
+		c.VoiceStates.Set(voiceStateKey{GuildID: state.GuildID, UserID: state.UserID}, state)
+		c.observeSet(storeVoiceState)
+		c.registerVoiceStateRelationship(state.GuildID, state.UserID)
+	}
+	c.VoiceStates.Unlock()
+
+	return nil
+}
+
+// Clear is used to drop all cached state, such as after a failed resume. The current user is reset to an empty user.
+// Each store is flushed in turn, so events handled concurrently may still land in stores which have already been cleared.
+func (c *cache) Clear() {
+	c.FlushGuilds()
+	c.FlushChannels()
+	c.FlushUsers()
+	c.FlushVoiceStates()
+	c.FlushMessages()
+	c.ResetCurrentUser()
+}
+
+// ResetCurrentUser is used to forget the current user, such as when logging in as a different bot.
+// Ready decodes into the current user, so without this any fields missing from the new Ready are kept from the old user.
+// The user is reset in place since the handlers decode into the same pointer.
+func (c *cache) ResetCurrentUser() {
+	c.CurrentUserMu.Lock()
+	*c.CurrentUser = disgord.User{}
+	c.CurrentUserMu.Unlock()
+}
+
+// FlushGuilds is used to drop every cached guild whilst leaving the other stores intact.
+// The last event times and voice servers of the guilds are forgotten with them.
+func (c *cache) FlushGuilds() {
+	c.Guilds.Lock()
+	c.Guilds.Erase()
+	c.Guilds.Unlock()
+
+	c.LastEventMu.Lock()
+	c.LastEvent = map[disgord.Snowflake]time.Time{}
+	c.LastEventMu.Unlock()
+
+	c.VoiceServerMu.Lock()
+	c.VoiceServers = map[disgord.Snowflake]*disgord.VoiceServerUpdate{}
+	c.VoiceServerMu.Unlock()
+}
+
+// FlushChannels is used to drop every cached channel along with the relationships whilst leaving the other stores intact.
+func (c *cache) FlushChannels() {
+	c.ChannelMu.Lock()
+	c.Channels.Erase()
+	c.GuildChannelRelationship = map[disgord.Snowflake]*list.List{}
+	c.DMChannelRelationship = map[disgord.Snowflake]disgord.Snowflake{}
+	c.ChannelMu.Unlock()
+}
+
+// FlushUsers is used to drop every cached user whilst leaving the other stores intact.
+// Guild members do not hold on to cached users, so membership is unaffected.
+func (c *cache) FlushUsers() {
+	c.Users.Lock()
+	c.Users.Erase()
+	c.Users.Unlock()
+}
+
+// FlushVoiceStates is used to drop every cached voice state whilst leaving the other stores intact.
+func (c *cache) FlushVoiceStates() {
+	c.VoiceStates.Lock()
+	c.VoiceStates.Erase()
+	c.GuildVoiceStateRelationship = map[disgord.Snowflake]map[disgord.Snowflake]uint64{}
+	c.VoiceStates.Unlock()
+}
+
+// FlushMessages is used to drop every cached message whilst leaving the other stores intact.
+func (c *cache) FlushMessages() {
+	if c.Messages == nil {
+		return
+	}
+	c.Messages.Lock()
+	c.Messages.Erase()
+	c.ChannelMessageRelationship = map[disgord.Snowflake][]disgord.Snowflake{}
+	c.Messages.Unlock()
+}
+
+// Stats is used to get the hit and miss counts of each store since the cache was created, along with how many items each store holds.
+func (c *cache) Stats() CacheStats {
+	s := &c.counters.stats
+	stats := CacheStats{
+		GuildHits:        atomic.LoadUint64(&s.GuildHits),
+		GuildMisses:      atomic.LoadUint64(&s.GuildMisses),
+		ChannelHits:      atomic.LoadUint64(&s.ChannelHits),
+		ChannelMisses:    atomic.LoadUint64(&s.ChannelMisses),
+		UserHits:         atomic.LoadUint64(&s.UserHits),
+		UserMisses:       atomic.LoadUint64(&s.UserMisses),
+		VoiceStateHits:   atomic.LoadUint64(&s.VoiceStateHits),
+		VoiceStateMisses: atomic.LoadUint64(&s.VoiceStateMisses),
+		MessageHits:      atomic.LoadUint64(&s.MessageHits),
+		MessageMisses:    atomic.LoadUint64(&s.MessageMisses),
+		GuildItems:       c.Guilds.Len(),
+		ChannelItems:     c.Channels.Len(),
+		UserItems:        c.Users.Len(),
+		VoiceStateItems:  c.VoiceStates.Len(),
+	}
+	if c.Messages != nil {
+		stats.MessageItems = c.Messages.Len()
+	}
+	return stats
+}
+
 // CacheConfig is used to define the cache configuration.
 type CacheConfig struct {
 	DoNotReturnGetGuildMembers bool
 
+	// RecoverHandlers turns panics inside of event handlers into errors. This is off by default to avoid masking bugs.
+	RecoverHandlers bool
+
+	// DebugConsistencyChecks validates the cached state after every mutating handler.
+	// Problems are logged if a Logger is set and panic otherwise, so this is off by default and meant for debugging.
+	DebugConsistencyChecks bool
+
+	// Logger is used to log any issues within the cache. This can be nil.
+	Logger disgord.Logger
+
+	// EvictionLogSampleRate logs one in every N evictions from the stores to the Logger at debug level.
+	// Zero means evictions are not logged.
+	EvictionLogSampleRate int
+
+	// OnRolesChanged is called with the guild ID when a guild update changes the guild's roles. This can be nil.
+	OnRolesChanged func(guildID disgord.Snowflake)
+
+	// OnEmojisChanged is called with the guild ID when a guild update or emojis update changes the guild's emojis. This can be nil.
+	OnEmojisChanged func(guildID disgord.Snowflake)
+
+	// These are called with a copy of each guild, user or voice state the TLRUs evict because it expired or the store was full,
+	// such as to persist it elsewhere. Voice states dropped for MaxVoiceStatesPerGuild are reported too. Items removed by events, flushes or EvictGuilds are not reported. Any can be nil.
+	// They are called in the order the items were evicted, from the goroutine which caused the eviction, once it has released the
+	// cache's locks and before any post handlers run. This means they are free to read from the cache, but the item may have been
+	// cached again by then.
+	OnGuildEvicted      func(guildID disgord.Snowflake, guild *disgord.Guild)
+	OnUserEvicted       func(userID disgord.Snowflake, user *disgord.User)
+	OnVoiceStateEvicted func(state *disgord.VoiceState)
+
+	// Messages are only cached if MessageMaxItems is set, so that bots which do not need them pay nothing.
+	// MessageMaxItems is the amount of messages kept for each channel, and the oldest messages of a channel are dropped to make room.
+	// MessageMaxBytes bounds the messages of every channel together. A zero MessageDuration means messages do not expire.
+	MessageMaxItems int
+	MessageMaxBytes int
+	MessageDuration time.Duration
+
+	// MessageChannelAllowlist limits message caching to the channels given, for bots which only care about a few channels.
+	// An empty allowlist means messages are cached for every channel.
+	MessageChannelAllowlist []disgord.Snowflake
+
+	// MetricsHook is told about the lookups and stores the cache makes. This can be nil.
+	MetricsHook MetricsHook
+
+	// StoreVoiceServers keeps the latest voice server update for each guild (see GetVoiceServer).
+	StoreVoiceServers bool
+
+	// Each store keeps at most MaxItems entries and MaxBytes bytes. Entries expire after Duration, but the TLRU
+	// resets the expiry of an entry whenever it is looked up, so entries which are read often stay cached.
 	UserMaxItems int
 	UserMaxBytes int
 	UserDuration time.Duration
@@ -514,18 +3374,132 @@ type CacheConfig struct {
 	GuildMaxItems int
 	GuildMaxBytes int
 	GuildDuration time.Duration
+
+	// The channel limits work like the others, except a zero ChannelDuration means channels do not expire.
+	ChannelMaxItems int
+	ChannelMaxBytes int
+	ChannelDuration time.Duration
+
+	// MaxVoiceStatesPerGuild caps the number of voice states kept for a single guild.
+	// When it is exceeded the least recently updated voice states are dropped. Zero means no cap.
+	MaxVoiceStatesPerGuild int
+
+	// GuildLockShards splits the guild lock into this many shards by guild ID so that different guilds can be worked on in parallel.
+	// Zero or one means a single lock is used.
+	GuildLockShards int
+}
+
+// NewCache is used to create a new cache. The Cache returned can be given straight to disgord as its cache.
+func NewCache(conf CacheConfig) Cache {
+	channelDuration := conf.ChannelDuration
+	if channelDuration == 0 {
+		// Channels were never expired before they had a TLRU, so keep it that way unless asked otherwise.
+		channelDuration = time.Duration(math.MaxInt64)
+	}
+	c := &cache{
+		ReturnGetGuildMembers:       !conf.DoNotReturnGetGuildMembers,
+		RecoverHandlers:             conf.RecoverHandlers,
+		DebugConsistencyChecks:      conf.DebugConsistencyChecks,
+		Logger:                      conf.Logger,
+		EvictionLogSampleRate:       conf.EvictionLogSampleRate,
+		OnRolesChanged:              conf.OnRolesChanged,
+		OnEmojisChanged:             conf.OnEmojisChanged,
+		OnGuildEvicted:              conf.OnGuildEvicted,
+		OnUserEvicted:               conf.OnUserEvicted,
+		OnVoiceStateEvicted:         conf.OnVoiceStateEvicted,
+		Metrics:                     conf.MetricsHook,
+		counters:                    &cacheCounters{},
+		CurrentUser:                 &disgord.User{},
+		ChannelMu:                   sync.RWMutex{},
+		GuildChannelRelationship:    map[disgord.Snowflake]*list.List{},
+		DMChannelRelationship:       map[disgord.Snowflake]disgord.Snowflake{},
+		LastEvent:                   map[disgord.Snowflake]time.Time{},
+		StoreVoiceServers:           conf.StoreVoiceServers,
+		VoiceServers:                map[disgord.Snowflake]*disgord.VoiceServerUpdate{},
+		GuildVoiceStateRelationship: map[disgord.Snowflake]map[disgord.Snowflake]uint64{},
+		PostHandlers:                map[string][]func(cache CacheReader, data []byte){},
+		MaxVoiceStatesPerGuild:      conf.MaxVoiceStatesPerGuild,
+		MessageMaxItems:             conf.MessageMaxItems,
+		ChannelMessageRelationship:  map[disgord.Snowflake][]disgord.Snowflake{},
+		now:                         time.Now,
+	}
+
+	// The stores read the time through the cache so that they share its clock.
+	now := func() time.Time {
+		return c.now()
+	}
+	c.Channels = newTLRU(conf.ChannelMaxItems, conf.ChannelMaxBytes, channelDuration, now)
+	c.Users = &tlruWrapper{tlruCache: newTLRU(conf.UserMaxItems, conf.UserMaxBytes, conf.UserDuration, now)}
+	c.VoiceStates = &tlruWrapper{tlruCache: newTLRU(conf.VoiceStatesMaxItems, conf.VoiceStatesMaxBytes, conf.VoiceStatesDuration, now)}
+	c.Guilds = newShardedTLRU(newTLRU(conf.GuildMaxItems, conf.GuildMaxBytes, conf.GuildDuration, now), conf.GuildLockShards)
+	if conf.MessageMaxItems > 0 {
+		messageDuration := conf.MessageDuration
+		if messageDuration == 0 {
+			messageDuration = time.Duration(math.MaxInt64)
+		}
+		// The amount of messages is bounded per channel by the relationships rather than by the TLRU, so a busy channel does not
+		// push out the history of every other channel.
+		c.Messages = &tlruWrapper{tlruCache: newTLRU(0, conf.MessageMaxBytes, messageDuration, now)}
+		if len(conf.MessageChannelAllowlist) != 0 {
+			c.MessageChannels = make(map[disgord.Snowflake]struct{}, len(conf.MessageChannelAllowlist))
+			for _, id := range conf.MessageChannelAllowlist {
+				c.MessageChannels[id] = struct{}{}
+			}
+		}
+	}
+	c.forgetEvicted()
+	return c
 }
 
-// NewCache is used to create a new cache.
-func NewCache(conf CacheConfig) disgord.Cache {
-	return &cache{
-		ReturnGetGuildMembers:    !conf.DoNotReturnGetGuildMembers,
-		CurrentUser:              &disgord.User{},
-		ChannelMu:                sync.RWMutex{},
-		Channels:                 map[disgord.Snowflake]*disgord.Channel{},
-		GuildChannelRelationship: map[disgord.Snowflake]*list.List{},
-		Users:                    &tlruWrapper{Cache: tlru.NewCache(conf.UserMaxItems, conf.UserMaxBytes, conf.UserDuration)},
-		VoiceStates:              &tlruWrapper{Cache: tlru.NewCache(conf.VoiceStatesMaxItems, conf.VoiceStatesMaxBytes, conf.VoiceStatesDuration)},
-		Guilds:                   &tlruWrapper{Cache: tlru.NewCache(conf.GuildMaxItems, conf.GuildMaxBytes, conf.GuildDuration)},
+// Used to log what the stores evict, forget the relationships of it so that the relationships only ever hold what is cached, and
+// queue it for the eviction callbacks.
+// The TLRUs only evict when an item is set, and the lock of a store is always held when setting items, so each of these runs under
+// the lock of its own store. The guild callback only takes leaf locks since the shard of the evicted guild may not be held.
+func (c *cache) forgetEvicted() {
+	c.Guilds.onEvict = func(key, value interface{}) {
+		c.logEviction(storeGuild, key)
+		guildId := key.(disgord.Snowflake)
+		c.forgetGuildEvents(guildId)
+		if c.OnGuildEvicted != nil {
+			guild := value.(*cachedGuild).Guild
+			c.queueEviction(func() {
+				// The shard of the guild may not be held here, and a handler which got the guild before it was evicted could
+				// still be using it, so it is copied under its own lock.
+				c.Guilds.LockKey(guildId)
+				cpy := copyGuildWithoutMembers(guild)
+				cpy.Members = copyMembers(guild.Members)
+				c.Guilds.UnlockKey(guildId)
+				c.OnGuildEvicted(guildId, cpy)
+			})
+		}
+	}
+	c.Channels.onEvict = func(key, value interface{}) {
+		c.logEviction(storeChannel, key)
+		channelId := key.(disgord.Snowflake)
+		c.destroyChannelRelationship(value.(*disgord.Channel).GuildID, channelId)
+		c.destroyDMRelationship(channelId)
+		c.destroyChannelMessages(channelId)
+	}
+	c.VoiceStates.onEvict = func(key, value interface{}) {
+		c.logEviction(storeVoiceState, key)
+		k := key.(voiceStateKey)
+		c.destroyVoiceStateRelationship(k.GuildID, k.UserID)
+		c.queueVoiceStateEviction(value.(*disgord.VoiceState))
+	}
+	c.Users.onEvict = func(key, value interface{}) {
+		c.logEviction(storeUser, key)
+		if c.OnUserEvicted != nil {
+			cpy := value.(*disgord.User).DeepCopy().(*disgord.User)
+			c.queueEviction(func() {
+				c.OnUserEvicted(key.(disgord.Snowflake), cpy)
+			})
+		}
+	}
+	if c.Messages != nil {
+		c.Messages.onEvict = func(key, _ interface{}) {
+			c.logEviction(storeMessage, key)
+			k := key.(messageKey)
+			c.destroyMessageRelationship(k.ChannelID, k.MessageID)
+		}
 	}
 }
@@ -0,0 +1,2921 @@
+package disgordtlru
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/andersfylling/disgord"
+	"github.com/andersfylling/disgord/json"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Used to create a cache for a test. The TLRU expires entries straight away with a zero duration, so any unset durations are made long enough to outlive the test.
+func newTestCache(conf CacheConfig) *cache {
+	if conf.UserDuration == 0 {
+		conf.UserDuration = time.Hour
+	}
+	if conf.VoiceStatesDuration == 0 {
+		conf.VoiceStatesDuration = time.Hour
+	}
+	if conf.GuildDuration == 0 {
+		conf.GuildDuration = time.Hour
+	}
+	return NewCache(conf).(*cache)
+}
+
+func TestRecoverHandlerReturnsEvent(t *testing.T) {
+	c := newTestCache(CacheConfig{RecoverHandlers: true})
+
+	// A single digit snowflake which is not quoted makes the snowflake decoder panic.
+	evt, err := c.ChannelCreate([]byte(`{"id":1}`))
+	if err == nil {
+		t.Fatal("expected the panic to be turned into an error")
+	}
+	if evt == nil {
+		t.Fatal("expected a non-nil event after recovering")
+	}
+}
+
+func TestNullPayloadsReturnEvents(t *testing.T) {
+	c := newTestCache(CacheConfig{MessageMaxItems: 10})
+	handlers := []string{
+		"ChannelCreate", "ChannelUpdate", "ChannelDelete", "ChannelPinsUpdate",
+		"MessageCreate", "MessageUpdate", "MessageDelete", "MessageDeleteBulk",
+		"VoiceStateUpdate", "VoiceServerUpdate",
+		"GuildMemberRemove", "GuildBanAdd", "GuildBanRemove", "GuildMemberAdd", "GuildMembersChunk",
+		"GuildCreate", "GuildUpdate", "GuildDelete", "GuildEmojisUpdate",
+		"GuildRoleCreate", "GuildRoleUpdate", "GuildRoleDelete",
+	}
+	for _, name := range handlers {
+		for _, payload := range []string{`null`, `{}`, `{`} {
+			// disgord uses the event even when the handler errors, so it must never be nil.
+			out := reflect.ValueOf(c).MethodByName(name).Call([]reflect.Value{reflect.ValueOf([]byte(payload))})
+			if out[0].IsNil() {
+				t.Errorf("%s returned a nil event for %s", name, payload)
+			}
+			if payload != `{` && !out[1].IsNil() {
+				t.Errorf("%s returned an error for %s: %v", name, payload, out[1].Interface())
+			}
+		}
+	}
+	if stats := c.Stats(); stats.GuildItems != 0 || stats.ChannelItems != 0 || stats.UserItems != 0 || stats.VoiceStateItems != 0 || stats.MessageItems != 0 {
+		t.Errorf("expected the empty payloads to cache nothing, got %+v", stats)
+	}
+}
+
+func TestGuildMembersChunkNullMember(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","members":[]}`)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := c.GuildMembersChunk([]byte(`{"guild_id":"10","members":[null,{"user":{"id":"20","public_flags":64}},null,{"user":{"id":"21","public_flags":128}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for userID, flags := range map[disgord.Snowflake]disgord.UserFlag{20: 64, 21: 128} {
+		if member, _ := c.GetMember(10, userID); member == nil {
+			t.Errorf("member %s was not cached", userID)
+		}
+		if got, _ := c.GetUserFlags(userID); got != flags {
+			t.Errorf("user %s has flags %d, expected %d", userID, got, flags)
+		}
+	}
+}
+
+// Defines a clock which only moves when told to.
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time {
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+// Used to give a cache a clock which only moves when told to.
+func useTestClock(c *cache) *testClock {
+	clock := &testClock{t: time.Unix(1600000000, 0)}
+	c.now = clock.now
+	return clock
+}
+
+func TestSelfCheck(t *testing.T) {
+	c := newTestCache(CacheConfig{GuildDuration: time.Minute})
+	clock := useTestClock(c)
+	if _, err := c.GuildCreate([]byte(`{"id":"10","channels":[{"id":"11","guild_id":"10"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Healthy() {
+		t.Fatalf("expected a healthy cache, got %v", c.SelfCheck())
+	}
+
+	// The probe must not revive the guild, otherwise probing often would stop it from ever expiring.
+	clock.advance(40 * time.Second)
+	c.SelfCheck()
+	clock.advance(40 * time.Second)
+	if guild, _ := c.GetGuild(10); guild != nil {
+		t.Error("expected the guild to have expired despite the self check")
+	}
+
+	c.ChannelMu.Lock()
+	c.GuildChannelRelationship = nil
+	c.ChannelMu.Unlock()
+	if c.Healthy() {
+		t.Error("expected a missing relationship map to be unhealthy")
+	}
+}
+
+func TestSelfCheckCorruptStore(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10"}`)); err != nil {
+		t.Fatal(err)
+	}
+	c.Guilds.Lock()
+	c.Guilds.valueMap = map[interface{}]*list.Element{}
+	c.Guilds.Unlock()
+	if c.SelfCheck() == nil {
+		t.Error("expected a TLRU whose list and map disagree to be unhealthy")
+	}
+}
+
+func TestEnumerationDoesNotRevive(t *testing.T) {
+	c := newTestCache(CacheConfig{GuildDuration: time.Minute, ChannelDuration: time.Minute})
+	clock := useTestClock(c)
+	if _, err := c.GuildCreate([]byte(`{"id":"10","channels":[{"id":"11","guild_id":"10"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.advance(40 * time.Second)
+	guilds, _ := c.GetAllGuilds()
+	channels, _ := c.GetAllChannels()
+	if len(guilds) != 1 || len(channels) != 1 {
+		t.Fatalf("expected 1 guild and 1 channel, got %d and %d", len(guilds), len(channels))
+	}
+	if _, ok := c.GetGuildCreatedAt(10); !ok {
+		t.Fatal("expected the guild to be cached")
+	}
+
+	clock.advance(40 * time.Second)
+	guilds, _ = c.GetAllGuilds()
+	channels, _ = c.GetAllChannels()
+	if len(guilds) != 0 || len(channels) != 0 {
+		t.Errorf("expected everything to have expired, got %d guilds and %d channels", len(guilds), len(channels))
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	// Snowflakes are encoded as bare numbers, which the snowflake decoder cannot read back for single digit IDs.
+	c := newTestCache(CacheConfig{})
+	if _, err := c.Ready([]byte(`{"user":{"id":"100","username":"bot"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GuildCreate([]byte(`{"id":"10","name":"guild","channels":[{"id":"11","guild_id":"10","name":"general"}],"members":[{"user":{"id":"20"}}],"voice_states":[{"user_id":"20","channel_id":"11"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GuildMemberAdd([]byte(`{"guild_id":"10","user":{"id":"21","username":"user"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestCache(CacheConfig{})
+	if err := restored.Restore(data); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := restored.GetCurrentUser(); user == nil || user.ID != 100 {
+		t.Errorf("expected the current user to be restored, got %v", user)
+	}
+	if guild, _ := restored.GetGuild(10); guild == nil || guild.Name != "guild" || len(guild.Members) != 2 {
+		t.Errorf("expected the guild and its members to be restored, got %v", guild)
+	}
+	if channels, _ := restored.GetGuildChannels(10); len(channels) != 1 || channels[0].Name != "general" {
+		t.Errorf("expected the guild channel relationship to be rebuilt, got %v", channels)
+	}
+	if user, _ := restored.GetUser(21); user == nil || user.Username != "user" {
+		t.Errorf("expected the user to be restored, got %v", user)
+	}
+	if state, _ := restored.GetVoiceState(10, 20); state == nil || state.ChannelID != 11 {
+		t.Errorf("expected the voice state to be restored, got %v", state)
+	}
+}
+
+func TestSnapshotOnlyHoldsLiveUsers(t *testing.T) {
+	c := newTestCache(CacheConfig{UserMaxItems: 2})
+	c.Users.Lock()
+	for i := 100; i < 1100; i++ {
+		c.setUser(&disgord.User{ID: disgord.Snowflake(i)})
+	}
+	c.Users.Unlock()
+
+	data, err := c.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot cacheSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Users) != 2 {
+		t.Errorf("expected only the 2 users still cached to be snapshotted, got %d", len(snapshot.Users))
+	}
+}
+
+// Used to feed a message create for a test.
+func createMessage(t *testing.T, c *cache, channelID, messageID int) {
+	t.Helper()
+	_, err := c.MessageCreate([]byte(fmt.Sprintf(`{"id":"%d","channel_id":"%d","content":"hello"}`, messageID, channelID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMessagesBoundedPerChannel(t *testing.T) {
+	c := newTestCache(CacheConfig{MessageMaxItems: 2})
+	createMessage(t, c, 10, 100)
+	for id := 200; id < 210; id++ {
+		createMessage(t, c, 20, id)
+	}
+
+	// The busy channel must not push out the history of the quiet one.
+	if msg, _ := c.GetMessage(10, 100); msg == nil {
+		t.Error("expected the message in the quiet channel to still be cached")
+	}
+	messages, _ := c.GetChannelMessages(20, 0)
+	if len(messages) != 2 || messages[0].ID != 209 || messages[1].ID != 208 {
+		t.Errorf("expected only the 2 newest messages to be kept, got %v", messages)
+	}
+	if len(c.ChannelMessageRelationship[20]) != 2 {
+		t.Errorf("expected the relationship to be trimmed, got %v", c.ChannelMessageRelationship[20])
+	}
+}
+
+func TestMessageEvictionsPruneRelationships(t *testing.T) {
+	c := newTestCache(CacheConfig{MessageMaxItems: 10, MessageDuration: time.Minute})
+	clock := useTestClock(c)
+	createMessage(t, c, 10, 100)
+	clock.advance(time.Minute)
+	createMessage(t, c, 20, 200)
+	if _, ok := c.ChannelMessageRelationship[10]; ok {
+		t.Error("expected the expired message to be dropped from the relationships")
+	}
+}
+
+func TestMessageDeletes(t *testing.T) {
+	c := newTestCache(CacheConfig{MessageMaxItems: 10})
+	for id := 100; id < 104; id++ {
+		createMessage(t, c, 10, id)
+	}
+	msg, _ := c.GetMessage(10, 100)
+	msg.Content = "changed"
+	if cached, _ := c.GetMessage(10, 100); cached.Content != "hello" {
+		t.Error("expected GetMessage to return a copy")
+	}
+
+	if _, err := c.MessageDelete([]byte(`{"id":"100","channel_id":"10"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.MessageDeleteBulk([]byte(`{"ids":["101","102"],"channel_id":"10"}`)); err != nil {
+		t.Fatal(err)
+	}
+	messages, _ := c.GetChannelMessages(10, 0)
+	if len(messages) != 1 || messages[0].ID != 103 {
+		t.Errorf("expected only message 103 to be left, got %v", messages)
+	}
+}
+
+func TestGuildDeleteDropsMessages(t *testing.T) {
+	c := newTestCache(CacheConfig{MessageMaxItems: 10})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","channels":[{"id":"11","guild_id":"10"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	createMessage(t, c, 11, 100)
+	if _, err := c.GuildDelete([]byte(`{"id":"10"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ := c.GetMessage(11, 100); msg != nil {
+		t.Error("expected the messages of the guild's channels to be dropped")
+	}
+	if len(c.ChannelMessageRelationship) != 0 {
+		t.Errorf("expected no message relationships to be left, got %v", c.ChannelMessageRelationship)
+	}
+}
+
+func TestResetCurrentUser(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.Ready([]byte(`{"user":{"id":"100","username":"old","avatar":"abc"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	c.ResetCurrentUser()
+	if user, _ := c.GetCurrentUser(); user == nil || user.ID != 0 || user.Username != "" {
+		t.Fatalf("expected the current user to be cleared, got %v", user)
+	}
+
+	if _, err := c.Ready([]byte(`{"user":{"id":"200","username":"new"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := c.GetCurrentUser(); user.ID != 200 || user.Username != "new" || user.Avatar != "" {
+		t.Errorf("expected only the new user to be bound, got %v", user)
+	}
+}
+
+func TestResetCurrentUserConcurrently(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c.ResetCurrentUser()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := c.UserUpdate([]byte(`{"id":"100","username":"bot"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+// Defines a logger which keeps the debug logs and errors logged to it.
+type testLogger struct {
+	mu     sync.Mutex
+	debugs []string
+	errors []string
+}
+
+func (l *testLogger) Debug(v ...interface{}) {
+	l.mu.Lock()
+	l.debugs = append(l.debugs, fmt.Sprint(v...))
+	l.mu.Unlock()
+}
+
+func (l *testLogger) Info(v ...interface{}) {}
+
+func (l *testLogger) Error(v ...interface{}) {
+	l.mu.Lock()
+	l.errors = append(l.errors, fmt.Sprint(v...))
+	l.mu.Unlock()
+}
+
+func TestMemberCountDoesNotUnderflow(t *testing.T) {
+	logger := &testLogger{}
+	c := newTestCache(CacheConfig{DebugConsistencyChecks: true, Logger: logger})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","member_count":0,"members":[]}`)); err != nil {
+		t.Fatal(err)
+	}
+	c.Guilds.LockKey(10)
+	entry, _ := c.getCachedGuild(10)
+	entry.addMember(&disgord.Member{UserID: 20})
+	c.Guilds.UnlockKey(10)
+
+	if _, err := c.GuildMemberRemove([]byte(`{"guild_id":"10","user":{"id":"20"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if guild, _ := c.GetGuild(10); guild.MemberCount != 0 {
+		t.Errorf("expected the member count to stay at 0, got %d", guild.MemberCount)
+	}
+}
+
+func TestConsistencyChecksDetectViolations(t *testing.T) {
+	logger := &testLogger{}
+	c := newTestCache(CacheConfig{DebugConsistencyChecks: true, Logger: logger})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","member_count":1,"members":[{"user":{"id":"20"}}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(logger.errors) != 0 {
+		t.Fatalf("expected a consistent guild, got %v", logger.errors)
+	}
+
+	// Loading more members than the guild has is impossible, as is a member the index does not know about.
+	c.Guilds.LockKey(10)
+	guild, _ := c.getGuild(10)
+	guild.Members = append(guild.Members, &disgord.Member{UserID: 21})
+	c.Guilds.UnlockKey(10)
+	if _, err := c.GuildRoleDelete([]byte(`{"guild_id":"10","role_id":"30"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(logger.errors) != 2 {
+		t.Errorf("expected the member count and index violations to be logged, got %v", logger.errors)
+	}
+
+	// Without a logger, violations panic.
+	c.Logger = nil
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a violation to panic without a logger")
+		}
+	}()
+	c.GuildRoleDelete([]byte(`{"guild_id":"10","role_id":"30"}`))
+}
+
+func TestGetMemberRoles(t *testing.T) {
+	// The methods added on top of disgord.Cache are reachable through what NewCache returns.
+	var c Cache = NewCache(CacheConfig{GuildDuration: time.Hour})
+	_, err := c.GuildCreate([]byte(`{"id":"10","roles":[{"id":"10","name":"@everyone"},{"id":"30","name":"a"},{"id":"31","name":"b"}],"members":[{"user":{"id":"20"},"roles":["30","31","99"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles, err := c.GetMemberRoles(10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 2 || roles[0].Name != "a" || roles[1].Name != "b" {
+		t.Fatalf("expected roles a and b with the stale role skipped, got %v", roles)
+	}
+
+	roles[0].Name = "changed"
+	if roles, _ := c.GetMemberRoles(10, 20); roles[0].Name != "a" {
+		t.Error("expected the roles to be copies")
+	}
+}
+
+func TestChannelPinsUpdateIsVisibleInGetChannel(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.ChannelCreate([]byte(`{"id":"11","guild_id":"10","name":"general"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ChannelPinsUpdate([]byte(`{"channel_id":"11","guild_id":"10","last_pin_timestamp":"2020-08-23T15:00:00+00:00"}`)); err != nil {
+		t.Fatal(err)
+	}
+	channel, _ := c.GetChannel(11)
+	if channel == nil {
+		t.Fatal("expected the channel to be cached")
+	}
+	expected := time.Date(2020, 8, 23, 15, 0, 0, 0, time.UTC)
+	if !channel.LastPinTimestamp.Time.Equal(expected) {
+		t.Errorf("expected the last pin timestamp to be %v, got %v", expected, channel.LastPinTimestamp.Time)
+	}
+}
+
+func TestSnowflakeEncodings(t *testing.T) {
+	// The snowflake decoder cannot read bare numbers with a single digit, but real snowflakes are never that short.
+	for _, id := range []string{`"110"`, `110`} {
+		c := newTestCache(CacheConfig{})
+		if _, err := c.ChannelUpdate([]byte(`{"id":` + id + `,"guild_id":` + id + `,"name":"general"}`)); err != nil {
+			t.Fatal(err)
+		}
+		if channel, _ := c.GetChannel(110); channel == nil || channel.GuildID != 110 {
+			t.Errorf("expected the channel to be cached under 110 for %s, got %v", id, channel)
+		}
+		if _, err := c.ChannelUpdate([]byte(`{"id":` + id + `,"name":"renamed"}`)); err != nil {
+			t.Fatal(err)
+		}
+		if channel, _ := c.GetChannel(110); channel == nil || channel.Name != "renamed" {
+			t.Errorf("expected the cached channel to be updated for %s, got %v", id, channel)
+		}
+
+		if _, err := c.GuildUpdate([]byte(`{"id":` + id + `,"name":"guild"}`)); err != nil {
+			t.Fatal(err)
+		}
+		if guild, _ := c.GetGuild(110); guild == nil || guild.Name != "guild" {
+			t.Errorf("expected the guild to be cached under 110 for %s, got %v", id, guild)
+		}
+	}
+}
+
+func TestShardedGuildLockConcurrently(t *testing.T) {
+	// This is mostly useful under -race.
+	c := newTestCache(CacheConfig{GuildLockShards: 4})
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				// Workers share guilds in pairs so that the same shard is contended as well as different ones.
+				guildID := 100 + worker/2
+				c.GuildCreate([]byte(fmt.Sprintf(`{"id":"%d","member_count":1,"members":[{"user":{"id":"%d"}}]}`, guildID, 200+worker)))
+				c.GuildMemberAdd([]byte(fmt.Sprintf(`{"guild_id":"%d","user":{"id":"%d"}}`, guildID, 300+i)))
+				c.GetMember(disgord.Snowflake(guildID), disgord.Snowflake(300+i))
+				c.GetAllGuilds()
+				if i%10 == 0 {
+					c.GuildDelete([]byte(fmt.Sprintf(`{"id":"%d"}`, guildID)))
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	if err := c.SelfCheck(); err != nil {
+		t.Error(err)
+	}
+}
+
+func BenchmarkConcurrentGuildUpdates(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			c := newTestCache(CacheConfig{GuildLockShards: shards})
+			payloads := make([][]byte, 64)
+			for i := range payloads {
+				c.GuildCreate([]byte(fmt.Sprintf(`{"id":"%d"}`, 100+i)))
+				payloads[i] = []byte(fmt.Sprintf(`{"guild_id":"%d","role":{"id":"%d","name":"role"}}`, 100+i, 1000+i))
+			}
+			var next uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c.GuildRoleUpdate(payloads[atomic.AddUint64(&next, 1)%uint64(len(payloads))])
+				}
+			})
+		})
+	}
+}
+
+// Used to build a guild with the given amount of members, roles and emojis for benchmarks.
+func largeGuild(members, roles, emojis int) *disgord.Guild {
+	guild := &disgord.Guild{ID: 10, Name: "large", MemberCount: uint(members)}
+	for i := 0; i < members; i++ {
+		userID := disgord.Snowflake(1000 + i)
+		guild.Members = append(guild.Members, &disgord.Member{GuildID: 10, UserID: userID, Nick: "member", Roles: []disgord.Snowflake{100}})
+	}
+	for i := 0; i < roles; i++ {
+		guild.Roles = append(guild.Roles, &disgord.Role{ID: disgord.Snowflake(100 + i), Name: "role", Position: i})
+	}
+	for i := 0; i < emojis; i++ {
+		guild.Emojis = append(guild.Emojis, &disgord.Emoji{ID: disgord.Snowflake(500000 + i), Name: "emoji"})
+	}
+	return guild
+}
+
+func BenchmarkCopyGuildWithoutMembers(b *testing.B) {
+	guild := largeGuild(50000, 250, 250)
+	b.Run("deep_copy", func(b *testing.B) {
+		// This is how guilds were copied before, hiding the members from the deep copy and putting them back after.
+		for i := 0; i < b.N; i++ {
+			members := guild.Members
+			guild.Members = []*disgord.Member{}
+			guild.DeepCopy()
+			guild.Members = members
+		}
+	})
+	b.Run("targeted", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			copyGuildWithoutMembers(guild)
+		}
+	})
+}
+
+// Used to find a member by scanning the guild members as GetMember did before the member index.
+func scanMember(c *cache, guildID, userID disgord.Snowflake) *disgord.Member {
+	c.Guilds.LockKey(guildID)
+	defer c.Guilds.UnlockKey(guildID)
+	guild, ok := c.getGuild(guildID)
+	if !ok {
+		return nil
+	}
+	for _, member := range guild.Members {
+		if member.UserID == userID {
+			return copyMember(member)
+		}
+	}
+	return nil
+}
+
+// Used to create a cache holding a large guild.
+func newLargeGuildCache(members int) *cache {
+	c := newTestCache(CacheConfig{})
+	c.Guilds.LockKey(10)
+	c.setGuild(largeGuild(members, 10, 0))
+	c.Guilds.UnlockKey(10)
+	return c
+}
+
+func TestGetMemberMatchesScan(t *testing.T) {
+	c := newLargeGuildCache(1000)
+	for _, userID := range []disgord.Snowflake{1000, 1500, 1999, 5} {
+		member, _ := c.GetMember(10, userID)
+		if expected := scanMember(c, 10, userID); !reflect.DeepEqual(member, expected) {
+			t.Errorf("expected member %s to be %v, got %v", userID, expected, member)
+		}
+	}
+}
+
+func BenchmarkGetMember(b *testing.B) {
+	c := newLargeGuildCache(50000)
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			scanMember(c, 10, disgord.Snowflake(1000+(i*7919)%50000))
+		}
+	})
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			c.GetMember(10, disgord.Snowflake(1000+(i*7919)%50000))
+		}
+	})
+}
+
+func BenchmarkGuildMemberAddRemove(b *testing.B) {
+	add := []byte(`{"guild_id":"10","user":{"id":"999"}}`)
+	remove := []byte(`{"guild_id":"10","user":{"id":"999"}}`)
+	b.Run("scan", func(b *testing.B) {
+		// This is how members were added and removed before the member index, scanning the members each time.
+		guild := largeGuild(50000, 10, 0)
+		for i := 0; i < b.N; i++ {
+			found := false
+			for _, member := range guild.Members {
+				if member.UserID == 999 {
+					found = true
+					break
+				}
+			}
+			if !found {
+				guild.Members = append(guild.Members, &disgord.Member{GuildID: 10, UserID: 999})
+			}
+			for j, member := range guild.Members {
+				if member.UserID == 999 {
+					guild.Members = append(guild.Members[:j], guild.Members[j+1:]...)
+					break
+				}
+			}
+		}
+	})
+	b.Run("index", func(b *testing.B) {
+		c := newLargeGuildCache(50000)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			c.GuildMemberAdd(add)
+			c.GuildMemberRemove(remove)
+		}
+	})
+}
+
+func TestUserIDs(t *testing.T) {
+	c := newTestCache(CacheConfig{UserMaxItems: 3, UserDuration: time.Minute})
+	clock := useTestClock(c)
+	setUsers := func(ids ...disgord.Snowflake) {
+		c.Users.Lock()
+		for _, id := range ids {
+			c.setUser(&disgord.User{ID: id})
+		}
+		c.Users.Unlock()
+	}
+
+	// 14 and 10 are evicted for space, and the rest are listed by ID rather than by use.
+	setUsers(14, 10, 13, 12, 11)
+	if ids := c.UserIDs(); !reflect.DeepEqual(ids, []disgord.Snowflake{11, 12, 13}) {
+		t.Fatalf("expected users 11, 12 and 13, got %v", ids)
+	}
+
+	// 13 and 12 are evicted for space, and 11 expires.
+	clock.advance(30 * time.Second)
+	setUsers(16, 15)
+	clock.advance(31 * time.Second)
+	if ids := c.UserIDs(); !reflect.DeepEqual(ids, []disgord.Snowflake{15, 16}) {
+		t.Fatalf("expected users 15 and 16, got %v", ids)
+	}
+
+	// 16 is deleted.
+	c.Users.Lock()
+	c.Users.Delete(disgord.Snowflake(16))
+	c.Users.Unlock()
+	if ids := c.UserIDs(); !reflect.DeepEqual(ids, []disgord.Snowflake{15}) {
+		t.Fatalf("expected user 15, got %v", ids)
+	}
+
+	// Listing the users does not revive them.
+	clock.advance(30 * time.Second)
+	if ids := c.UserIDs(); len(ids) != 0 {
+		t.Fatalf("expected no users, got %v", ids)
+	}
+}
+
+func TestGetGuildsByFeature(t *testing.T) {
+	c := newTestCache(CacheConfig{DoNotReturnGetGuildMembers: true})
+	c.Guilds.Lock()
+	c.setGuild(&disgord.Guild{ID: 10, Features: []string{"COMMUNITY", "NEWS"}, Members: []*disgord.Member{{GuildID: 10, UserID: 100}}})
+	c.setGuild(&disgord.Guild{ID: 11, Features: []string{"NEWS"}})
+	c.setGuild(&disgord.Guild{ID: 12})
+	c.Guilds.Unlock()
+
+	guilds, err := c.GetGuildsByFeature("COMMUNITY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(guilds) != 1 || guilds[0].ID != 10 {
+		t.Fatalf("expected only guild 10, got %v", guilds)
+	}
+	if len(guilds[0].Members) != 0 {
+		t.Error("expected members to be left out with DoNotReturnGetGuildMembers")
+	}
+	guilds[0].Features[0] = "changed"
+	if guilds, _ := c.GetGuildsByFeature("COMMUNITY"); len(guilds) != 1 {
+		t.Error("expected the returned guild to be a copy")
+	}
+
+	c.ReturnGetGuildMembers = true
+	guilds, _ = c.GetGuildsByFeature("COMMUNITY")
+	if len(guilds) != 1 || len(guilds[0].Members) != 1 {
+		t.Error("expected members to be included otherwise")
+	}
+	if guilds, _ := c.GetGuildsByFeature("NEWS"); len(guilds) != 2 {
+		t.Errorf("expected 2 guilds with NEWS, got %d", len(guilds))
+	}
+	if guilds, _ := c.GetGuildsByFeature("VERIFIED"); len(guilds) != 0 {
+		t.Errorf("expected no guilds with VERIFIED, got %d", len(guilds))
+	}
+}
+
+func TestMessageChannelAllowlist(t *testing.T) {
+	c := newTestCache(CacheConfig{MessageMaxItems: 10, MessageChannelAllowlist: []disgord.Snowflake{10}})
+	createMessage(t, c, 10, 100)
+	createMessage(t, c, 11, 101)
+	if _, err := c.MessageUpdate([]byte(`{"id":"101","channel_id":"11","content":"edited"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := c.GetMessage(10, 100); err != nil || msg == nil {
+		t.Errorf("expected the message in the allowed channel to be cached, got %v, %v", msg, err)
+	}
+	if msg, _ := c.GetMessage(11, 101); msg != nil {
+		t.Error("expected the message outside the allowlist not to be cached")
+	}
+	if ids := c.ChannelMessageRelationship[11]; len(ids) != 0 {
+		t.Errorf("expected no relationship for the channel outside the allowlist, got %v", ids)
+	}
+	if _, err := c.MessageDelete([]byte(`{"id":"100","channel_id":"10"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ := c.GetMessage(10, 100); msg != nil {
+		t.Error("expected the deleted message in the allowed channel to be gone")
+	}
+
+	// Without an allowlist, every channel is cached.
+	c = newTestCache(CacheConfig{MessageMaxItems: 10})
+	createMessage(t, c, 11, 101)
+	if msg, err := c.GetMessage(11, 101); err != nil || msg == nil {
+		t.Errorf("expected the message to be cached without an allowlist, got %v, %v", msg, err)
+	}
+}
+
+func TestSnapshotDoesNotBlockReads(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	c.Guilds.Lock()
+	for i := 0; i < 200; i++ {
+		guild := largeGuild(100, 10, 10)
+		guild.ID = disgord.Snowflake(100 + i)
+		for _, member := range guild.Members {
+			member.GuildID = guild.ID
+		}
+		c.setGuild(guild)
+	}
+	c.Guilds.Unlock()
+
+	done := make(chan struct{})
+	var data []byte
+	var err error
+	go func() {
+		defer close(done)
+		data, err = c.Snapshot()
+	}()
+
+	// Keep reading and updating a guild until the snapshot is done. With the guilds copied under their own locks, these run alongside it.
+	reads := 0
+	for userID := 100000; ; userID++ {
+		select {
+		case <-done:
+		default:
+			if _, err := c.GuildMemberAdd([]byte(fmt.Sprintf(`{"guild_id":"100","user":{"id":"%d"}}`, userID))); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.ViewGuild(100, func(guild *disgord.Guild) error {
+				if int(guild.MemberCount) != len(guild.Members) {
+					return fmt.Errorf("expected the member count %d to match the %d members", guild.MemberCount, len(guild.Members))
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			reads++
+			continue
+		}
+		break
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reads == 0 {
+		t.Error("expected reads to get through while the snapshot was running")
+	}
+
+	restored := newTestCache(CacheConfig{})
+	if err := restored.Restore(data); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		guild, err := restored.GetGuild(disgord.Snowflake(100 + i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(guild.Members) < 100 || int(guild.MemberCount) != len(guild.Members) {
+			t.Fatalf("expected guild %d to be restored consistently, got %d members and a count of %d", guild.ID, len(guild.Members), guild.MemberCount)
+		}
+	}
+}
+
+func TestEvictGuildsTearsDownGuilds(t *testing.T) {
+	c := newTestCache(CacheConfig{MessageMaxItems: 10, StoreVoiceServers: true})
+	for _, data := range []string{
+		`{"id":"10","channels":[{"id":"11","guild_id":"10"}],"voice_states":[{"user_id":"20","channel_id":"11"}]}`,
+		`{"id":"12","channels":[{"id":"13","guild_id":"12"}],"voice_states":[{"user_id":"20","channel_id":"13"}]}`,
+	} {
+		if _, err := c.GuildCreate([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.VoiceServerUpdate([]byte(`{"guild_id":"10","token":"token","endpoint":"endpoint"}`)); err != nil {
+		t.Fatal(err)
+	}
+	createMessage(t, c, 11, 100)
+	createMessage(t, c, 13, 101)
+
+	c.EvictGuilds([]disgord.Snowflake{10})
+	if guild, _ := c.GetGuild(10); guild != nil {
+		t.Error("expected the guild to be evicted")
+	}
+	if channel, _ := c.GetChannel(11); channel != nil {
+		t.Error("expected the guild's channels to be evicted")
+	}
+	if msg, _ := c.GetMessage(11, 100); msg != nil || len(c.ChannelMessageRelationship[11]) != 0 {
+		t.Error("expected the messages of the guild's channels to be evicted")
+	}
+	if state, _ := c.GetVoiceState(10, 20); state != nil {
+		t.Error("expected the guild's voice states to be evicted")
+	}
+	if _, ok := c.GuildVoiceStateRelationship[10]; ok {
+		t.Error("expected the guild's voice state relationship to be evicted")
+	}
+	if _, ok := c.GuildLastEventTime(10); ok {
+		t.Error("expected the guild's last event time to be forgotten")
+	}
+	if _, ok := c.GetVoiceServer(10); ok {
+		t.Error("expected the guild's voice server to be forgotten")
+	}
+
+	// The other guild is left alone.
+	if guild, _ := c.GetGuild(12); guild == nil {
+		t.Error("expected the other guild to be kept")
+	}
+	if msg, _ := c.GetMessage(13, 101); msg == nil {
+		t.Error("expected the other guild's messages to be kept")
+	}
+	if state, _ := c.GetVoiceState(12, 20); state == nil {
+		t.Error("expected the other guild's voice states to be kept")
+	}
+	if errs := c.ValidateRelationships(); len(errs) != 0 {
+		t.Errorf("expected the relationships to be valid, got %v", errs)
+	}
+}
+
+func TestGuildLastEventTime(t *testing.T) {
+	c := newTestCache(CacheConfig{GuildDuration: time.Minute})
+	clock := useTestClock(c)
+	if _, err := c.GuildCreate([]byte(`{"id":"10"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if last, ok := c.GuildLastEventTime(10); !ok || !last.Equal(clock.now()) {
+		t.Fatalf("expected the guild create to be recorded at %v, got %v", clock.now(), last)
+	}
+	clock.advance(10 * time.Second)
+	if _, err := c.GuildRoleCreate([]byte(`{"guild_id":"10","role":{"id":"11"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if last, _ := c.GuildLastEventTime(10); !last.Equal(clock.now()) {
+		t.Errorf("expected the last event time to advance to %v, got %v", clock.now(), last)
+	}
+
+	// Events for guilds which are not cached are not tracked.
+	if _, err := c.GuildRoleCreate([]byte(`{"guild_id":"12","role":{"id":"13"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.GuildLastEventTime(12); ok {
+		t.Error("expected the uncached guild not to be tracked")
+	}
+
+	// The guild expires and is evicted when the next guild is set, which forgets its last event time.
+	clock.advance(time.Minute)
+	if _, err := c.GuildCreate([]byte(`{"id":"14"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.GuildLastEventTime(10); ok {
+		t.Error("expected the evicted guild's last event time to be forgotten")
+	}
+	if len(c.LastEvent) != 1 {
+		t.Errorf("expected only the cached guild to be tracked, got %v", c.LastEvent)
+	}
+
+	// Flushing the guilds forgets them too.
+	c.FlushGuilds()
+	if len(c.LastEvent) != 0 {
+		t.Errorf("expected no guilds to be tracked after a flush, got %v", c.LastEvent)
+	}
+}
+
+func TestVoiceStateEvictionsPruneRelationships(t *testing.T) {
+	c := newTestCache(CacheConfig{VoiceStatesMaxItems: 2, VoiceStatesDuration: time.Minute})
+	clock := useTestClock(c)
+	joinVoice := func(guildID, userID int) {
+		t.Helper()
+		if _, err := c.VoiceStateUpdate([]byte(fmt.Sprintf(`{"guild_id":"%d","user_id":"%d","channel_id":"99"}`, guildID, userID))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first voice state is evicted for space.
+	joinVoice(10, 20)
+	joinVoice(10, 21)
+	joinVoice(11, 22)
+	if users := c.GuildVoiceStateRelationship[10]; len(users) != 1 {
+		t.Errorf("expected the evicted voice state to be pruned, got %v", users)
+	}
+
+	// Counting does not revive, so both voice states expire and are pruned when the next one is set.
+	clock.advance(30 * time.Second)
+	if count := c.VoiceStateCount(); count != 2 {
+		t.Errorf("expected 2 voice states, got %d", count)
+	}
+	clock.advance(31 * time.Second)
+	if count := c.VoiceStateCount(); count != 0 {
+		t.Errorf("expected the expired voice states not to be counted, got %d", count)
+	}
+	joinVoice(12, 23)
+	if len(c.GuildVoiceStateRelationship) != 1 || len(c.GuildVoiceStateRelationship[12]) != 1 {
+		t.Errorf("expected only the new voice state to be left, got %v", c.GuildVoiceStateRelationship)
+	}
+}
+
+func TestPartialMessageUpdate(t *testing.T) {
+	c := newTestCache(CacheConfig{MessageMaxItems: 10})
+	if _, err := c.MessageCreate([]byte(`{"id":"100","channel_id":"10","content":"hello","embeds":[{"title":"first","description":"old"},{"title":"second"}],"attachments":[{"id":"200","filename":"a.png"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A content only edit keeps the embeds and attachments.
+	if _, err := c.MessageUpdate([]byte(`{"id":"100","channel_id":"10","content":"edited"}`)); err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := c.GetMessage(10, 100)
+	if msg == nil || msg.Content != "edited" {
+		t.Fatalf("expected the content to be edited, got %v", msg)
+	}
+	if len(msg.Embeds) != 2 || msg.Embeds[0].Title != "first" || len(msg.Attachments) != 1 {
+		t.Errorf("expected the embeds and attachments to be preserved, got %v and %v", msg.Embeds, msg.Attachments)
+	}
+
+	// An edit including the embeds replaces them whole, without stale fields from the old embeds.
+	if _, err := c.MessageUpdate([]byte(`{"id":"100","channel_id":"10","embeds":[{"title":"replaced"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	msg, _ = c.GetMessage(10, 100)
+	if len(msg.Embeds) != 1 || msg.Embeds[0].Title != "replaced" || msg.Embeds[0].Description != "" {
+		t.Errorf("expected the embeds to be replaced, got %v", msg.Embeds)
+	}
+	if msg.Content != "edited" || len(msg.Attachments) != 1 {
+		t.Errorf("expected the content and attachments to be preserved, got %q and %v", msg.Content, msg.Attachments)
+	}
+
+	// An edit including empty attachments clears them.
+	if _, err := c.MessageUpdate([]byte(`{"id":"100","channel_id":"10","attachments":[]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ = c.GetMessage(10, 100); len(msg.Attachments) != 0 {
+		t.Errorf("expected the attachments to be cleared, got %v", msg.Attachments)
+	}
+}
+
+func TestStatsItemCounts(t *testing.T) {
+	c := newTestCache(CacheConfig{MessageMaxItems: 10, UserDuration: time.Minute})
+	clock := useTestClock(c)
+	if _, err := c.GuildCreate([]byte(`{"id":"10","channels":[{"id":"11","guild_id":"10"},{"id":"12","guild_id":"10"}],"voice_states":[{"user_id":"20","channel_id":"11"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	createMessage(t, c, 11, 100)
+	c.Users.Lock()
+	c.setUser(&disgord.User{ID: 20})
+	c.setUser(&disgord.User{ID: 21})
+	c.Users.Unlock()
+	if _, err := c.GetGuild(10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetGuild(13); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := c.Stats()
+	expected := CacheStats{GuildItems: 1, ChannelItems: 2, UserItems: 2, VoiceStateItems: 1, MessageItems: 1}
+	if stats.GuildItems != expected.GuildItems || stats.ChannelItems != expected.ChannelItems || stats.UserItems != expected.UserItems ||
+		stats.VoiceStateItems != expected.VoiceStateItems || stats.MessageItems != expected.MessageItems {
+		t.Errorf("expected the item counts of %+v, got %+v", expected, stats)
+	}
+	if stats.GuildHits == 0 || stats.GuildMisses == 0 {
+		t.Errorf("expected the guild lookups to be counted, got %+v", stats)
+	}
+
+	// Expired users are not counted.
+	clock.advance(time.Minute)
+	if stats := c.Stats(); stats.UserItems != 0 {
+		t.Errorf("expected no users to be counted once they expired, got %d", stats.UserItems)
+	}
+}
+
+func TestGuildEmojisUpdate(t *testing.T) {
+	var changed []disgord.Snowflake
+	c := newTestCache(CacheConfig{OnEmojisChanged: func(guildID disgord.Snowflake) {
+		changed = append(changed, guildID)
+	}})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","emojis":[{"id":"11","name":"old"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GuildEmojisUpdate([]byte(`{"guild_id":"10","emojis":[{"id":"11","name":"old"},{"id":"12","name":"new"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if emoji, err := c.GetGuildEmoji(10, 12); err != nil || emoji == nil || emoji.Name != "new" {
+		t.Errorf("expected the added emoji to be cached, got %v, %v", emoji, err)
+	}
+	if !reflect.DeepEqual(changed, []disgord.Snowflake{10}) {
+		t.Errorf("expected the emojis changed callback to fire once for the guild, got %v", changed)
+	}
+
+	// The guild lock is released even when the guild is not cached.
+	if _, err := c.GuildEmojisUpdate([]byte(`{"guild_id":"13","emojis":[{"id":"14"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if emoji, _ := c.GetGuildEmoji(13, 14); emoji != nil {
+		t.Error("expected no emoji for the uncached guild")
+	}
+	if len(changed) != 1 {
+		t.Errorf("expected the callback not to fire for the uncached guild, got %v", changed)
+	}
+}
+
+func TestChannelEvictionsPruneRelationships(t *testing.T) {
+	c := newTestCache(CacheConfig{ChannelMaxItems: 2, MessageMaxItems: 10})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","channels":[{"id":"11","guild_id":"10"},{"id":"12","guild_id":"10"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	createMessage(t, c, 11, 100)
+	if _, err := c.ChannelCreate([]byte(`{"id":"13","type":1,"recipients":[{"id":"20"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Channel 11 is evicted for space, taking its relationship and messages with it.
+	if channels, _ := c.GetGuildChannels(10); len(channels) != 1 || channels[0].ID != 12 {
+		t.Errorf("expected only channel 12 to be left in the guild, got %v", channels)
+	}
+	if l := c.GuildChannelRelationship[10]; l == nil || l.Len() != 1 {
+		t.Error("expected the evicted channel to be pruned from the guild relationship")
+	}
+	if len(c.ChannelMessageRelationship) != 0 {
+		t.Errorf("expected the evicted channel's messages to be dropped, got %v", c.ChannelMessageRelationship)
+	}
+
+	// The DM channel is evicted next, which drops its recipient relationship.
+	if _, err := c.ChannelCreate([]byte(`{"id":"14","guild_id":"10"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ChannelCreate([]byte(`{"id":"15","guild_id":"10"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.DMChannelRelationship) != 0 {
+		t.Errorf("expected the evicted DM channel's relationship to be dropped, got %v", c.DMChannelRelationship)
+	}
+
+	// Replacing the channels of a guild with more than fit keeps the relationship in step with the store.
+	if _, err := c.GuildCreate([]byte(`{"id":"10","channels":[{"id":"16","guild_id":"10"},{"id":"17","guild_id":"10"},{"id":"18","guild_id":"10"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if channels, _ := c.GetGuildChannels(10); len(channels) != 2 || c.GuildChannelRelationship[10].Len() != 2 {
+		t.Errorf("expected the 2 channels which fit to be registered, got %v", channels)
+	}
+	if errs := c.ValidateRelationships(); len(errs) != 0 {
+		t.Errorf("expected the relationships to be valid, got %v", errs)
+	}
+}
+
+func TestGuildFreshness(t *testing.T) {
+	c := newTestCache(CacheConfig{GuildDuration: time.Minute})
+	clock := useTestClock(c)
+	if _, ok := c.GuildFreshness(10); ok {
+		t.Error("expected no freshness for an uncached guild")
+	}
+	if _, err := c.GuildCreate([]byte(`{"id":"10"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if freshness, ok := c.GuildFreshness(10); !ok || freshness != time.Minute {
+		t.Errorf("expected a minute of freshness, got %v", freshness)
+	}
+
+	// Checking the freshness does not revive the guild.
+	clock.advance(20 * time.Second)
+	if freshness, _ := c.GuildFreshness(10); freshness != 40*time.Second {
+		t.Errorf("expected 40 seconds of freshness, got %v", freshness)
+	}
+	clock.advance(20 * time.Second)
+	if freshness, _ := c.GuildFreshness(10); freshness != 20*time.Second {
+		t.Errorf("expected 20 seconds of freshness, got %v", freshness)
+	}
+
+	// Reading the guild revives it.
+	if _, err := c.GetGuild(10); err != nil {
+		t.Fatal(err)
+	}
+	if freshness, _ := c.GuildFreshness(10); freshness != time.Minute {
+		t.Errorf("expected the freshness to be reset to a minute, got %v", freshness)
+	}
+	clock.advance(time.Minute)
+	if _, ok := c.GuildFreshness(10); ok {
+		t.Error("expected no freshness for an expired guild")
+	}
+}
+
+func TestEvictionLogSampleRate(t *testing.T) {
+	logger := &testLogger{}
+	c := newTestCache(CacheConfig{UserMaxItems: 1, EvictionLogSampleRate: 10, Logger: logger})
+	c.Users.Lock()
+	for i := 0; i <= 1000; i++ {
+		c.setUser(&disgord.User{ID: disgord.Snowflake(100 + i)})
+	}
+	c.Users.Unlock()
+
+	// 1000 users were evicted, and one in every 10 evictions is logged.
+	if len(logger.debugs) != 100 {
+		t.Errorf("expected 100 evictions to be logged, got %d", len(logger.debugs))
+	}
+	if len(logger.debugs) != 0 && logger.debugs[0] != "disgordtlru: evicted user 100" {
+		t.Errorf("expected the first eviction to be logged, got %q", logger.debugs[0])
+	}
+
+	// Evictions are not logged without a sample rate.
+	logger = &testLogger{}
+	c = newTestCache(CacheConfig{UserMaxItems: 1, Logger: logger})
+	c.Users.Lock()
+	c.setUser(&disgord.User{ID: 100})
+	c.setUser(&disgord.User{ID: 101})
+	c.Users.Unlock()
+	if len(logger.debugs) != 0 {
+		t.Errorf("expected no evictions to be logged, got %v", logger.debugs)
+	}
+}
+
+func TestEvictionCallbacks(t *testing.T) {
+	var order []string
+	var evictedGuild *disgord.Guild
+	var evictedUsers []disgord.Snowflake
+	var evictedStates []disgord.Snowflake
+	var c *cache
+	c = newTestCache(CacheConfig{
+		GuildMaxItems:          1,
+		UserMaxItems:           1,
+		UserDuration:           time.Minute,
+		MaxVoiceStatesPerGuild: 1,
+		OnGuildEvicted: func(guildID disgord.Snowflake, guild *disgord.Guild) {
+			// The callback is free to read from the cache.
+			if cached, _ := c.GetGuild(11); cached == nil {
+				t.Error("expected the guild which caused the eviction to be cached")
+			}
+			order = append(order, "evicted")
+			evictedGuild = guild
+		},
+		OnUserEvicted: func(userID disgord.Snowflake, user *disgord.User) {
+			if user.ID != userID {
+				t.Errorf("expected user %s, got %s", userID, user.ID)
+			}
+			evictedUsers = append(evictedUsers, userID)
+		},
+		OnVoiceStateEvicted: func(state *disgord.VoiceState) {
+			evictedStates = append(evictedStates, state.UserID)
+		},
+	})
+	clock := useTestClock(c)
+	c.RegisterPostHandler(disgord.EvtGuildCreate, func(CacheReader, []byte) {
+		order = append(order, "post")
+	})
+
+	// The guild is evicted for space, and reported with its members before the post handlers run.
+	if _, err := c.GuildCreate([]byte(`{"id":"10","name":"first","members":[{"user":{"id":"20"}}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	order = nil
+	if _, err := c.GuildCreate([]byte(`{"id":"11"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if evictedGuild == nil || evictedGuild.ID != 10 || evictedGuild.Name != "first" || len(evictedGuild.Members) != 1 {
+		t.Errorf("expected guild 10 to be reported with its members, got %v", evictedGuild)
+	}
+	if !reflect.DeepEqual(order, []string{"evicted", "post"}) {
+		t.Errorf("expected the eviction to be reported before the post handlers, got %v", order)
+	}
+
+	// Users are reported when they are evicted for space or expire.
+	for _, userID := range []int{30, 31} {
+		if _, err := c.GuildMemberAdd([]byte(fmt.Sprintf(`{"guild_id":"11","user":{"id":"%d"}}`, userID))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.advance(time.Minute)
+	if _, err := c.GuildMemberAdd([]byte(`{"guild_id":"11","user":{"id":"32"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(evictedUsers, []disgord.Snowflake{30, 31}) {
+		t.Errorf("expected users 30 and 31 to be reported, got %v", evictedUsers)
+	}
+
+	// Voice states dropped for the per guild cap are reported.
+	for _, userID := range []int{40, 41} {
+		if _, err := c.VoiceStateUpdate([]byte(fmt.Sprintf(`{"guild_id":"11","user_id":"%d","channel_id":"99"}`, userID))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(evictedStates, []disgord.Snowflake{40}) {
+		t.Errorf("expected voice state 40 to be reported, got %v", evictedStates)
+	}
+
+	// Removing items directly is not reported.
+	if _, err := c.GuildDelete([]byte(`{"id":"11"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if evictedGuild.ID != 10 {
+		t.Errorf("expected the deleted guild not to be reported, got %v", evictedGuild)
+	}
+	if len(c.Evictions) != 0 {
+		t.Errorf("expected no evictions to be left queued, got %d", len(c.Evictions))
+	}
+}
+
+func TestGetGuildRolesSorted(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","roles":[{"id":"10","position":0},{"id":"13","position":2},{"id":"11","position":5},{"id":"12","position":2}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	roles, err := c.GetGuildRolesSorted(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []disgord.Snowflake
+	for _, role := range roles {
+		ids = append(ids, role.ID)
+	}
+	// Ties on position are broken by the lowest ID.
+	if !reflect.DeepEqual(ids, []disgord.Snowflake{11, 12, 13, 10}) {
+		t.Errorf("expected the roles in the order 11, 12, 13, 10, got %v", ids)
+	}
+	if roles, _ := c.GetGuildRolesSorted(20); roles != nil {
+		t.Errorf("expected no roles for an uncached guild, got %v", roles)
+	}
+}
+
+func TestGetMemberHighestRole(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","roles":[{"id":"10","position":0},{"id":"11","position":1},{"id":"12","position":3}],"members":[{"user":{"id":"20"},"roles":["11","12"]},{"user":{"id":"21"},"roles":["11"]},{"user":{"id":"22"},"roles":[]}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	for userID, expected := range map[disgord.Snowflake]disgord.Snowflake{20: 12, 21: 11, 22: 10} {
+		role, err := c.GetMemberHighestRole(10, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if role == nil || role.ID != expected {
+			t.Errorf("expected the highest role of %s to be %s, got %v", userID, expected, role)
+		}
+	}
+	if role, _ := c.GetMemberHighestRole(10, 23); role != nil {
+		t.Errorf("expected no role for an uncached member, got %v", role)
+	}
+}
+
+func TestVoiceStateUpdateDisconnect(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.VoiceStateUpdate([]byte(`{"guild_id":"10","user_id":"20","channel_id":"11"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := c.GetVoiceState(10, 20); state == nil || state.ChannelID != 11 {
+		t.Fatalf("expected the user to be in channel 11, got %v", state)
+	}
+	if _, err := c.VoiceStateUpdate([]byte(`{"guild_id":"10","user_id":"20","channel_id":null}`)); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := c.GetVoiceState(10, 20); state != nil {
+		t.Errorf("expected the voice state to be cleared after disconnecting, got %v", state)
+	}
+	if _, ok := c.GuildVoiceStateRelationship[10]; ok {
+		t.Error("expected the voice state relationship to be cleared after disconnecting")
+	}
+}
+
+func TestPartialUserKeepsRicherFields(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildMemberAdd([]byte(`{"guild_id":"10","user":{"id":"20","username":"user","discriminator":"1234","avatar":"avatar","bot":true}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GuildMemberAdd([]byte(`{"guild_id":"11","user":{"id":"20"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	user, _ := c.GetUser(20)
+	if user == nil || user.Username != "user" || user.Discriminator != 1234 || user.Avatar != "avatar" || !user.Bot {
+		t.Errorf("expected the richer user fields to survive the partial user, got %+v", user)
+	}
+
+	// Fields present in the partial user are still updated.
+	if _, err := c.GuildMemberAdd([]byte(`{"guild_id":"11","user":{"id":"20","username":"renamed"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := c.GetUser(20); user.Username != "renamed" || user.Avatar != "avatar" {
+		t.Errorf("expected only the username to change, got %+v", user)
+	}
+}
+
+func TestGetDMChannelForUser(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.ChannelCreate([]byte(`{"id":"11","type":1,"recipients":[{"id":"20"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	channel, err := c.GetDMChannelForUser(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel == nil || channel.ID != 11 {
+		t.Fatalf("expected DM channel 11, got %v", channel)
+	}
+	if channel, _ := c.GetDMChannelForUser(21); channel != nil {
+		t.Errorf("expected no DM channel for another user, got %v", channel)
+	}
+
+	// Deleting the channel drops the lookup.
+	if _, err := c.ChannelDelete([]byte(`{"id":"11","type":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if channel, _ := c.GetDMChannelForUser(20); channel != nil {
+		t.Errorf("expected no DM channel once it was deleted, got %v", channel)
+	}
+}
+
+func TestGetGuildWidget(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, _, ok := c.GetGuildWidget(10); !ok || enabled {
+		t.Errorf("expected the widget to start disabled, got %v, %v", enabled, ok)
+	}
+	if _, err := c.GuildUpdate([]byte(`{"id":"10","widget_enabled":true,"widget_channel_id":"11"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, channelID, ok := c.GetGuildWidget(10); !ok || !enabled || channelID != 11 {
+		t.Errorf("expected the widget to be enabled for channel 11, got %v, %v, %v", enabled, channelID, ok)
+	}
+	if _, _, ok := c.GetGuildWidget(12); ok {
+		t.Error("expected no widget settings for an uncached guild")
+	}
+}
+
+func TestGuildRejoinLeavesNoStaleState(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","channels":[{"id":"11","guild_id":"10"},{"id":"12","guild_id":"10"}],"members":[{"user":{"id":"20"}}],"voice_states":[{"user_id":"20","channel_id":"11"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GuildDelete([]byte(`{"id":"10"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GuildCreate([]byte(`{"id":"10","channels":[{"id":"13","guild_id":"10"}],"members":[{"user":{"id":"21"}}]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	channels, _ := c.GetGuildChannels(10)
+	if len(channels) != 1 || channels[0].ID != 13 {
+		t.Errorf("expected only the new channel, got %v", channels)
+	}
+	for _, id := range []disgord.Snowflake{11, 12} {
+		if channel, _ := c.GetChannel(id); channel != nil {
+			t.Errorf("expected old channel %s to be gone", id)
+		}
+	}
+	if member, _ := c.GetMember(10, 20); member != nil {
+		t.Error("expected the old member to be gone")
+	}
+	if member, _ := c.GetMember(10, 21); member == nil {
+		t.Error("expected the new member to be cached")
+	}
+	if states, _ := c.GetGuildVoiceStates(10); len(states) != 0 {
+		t.Errorf("expected the old voice states to be gone, got %v", states)
+	}
+	if errs := c.ValidateRelationships(); len(errs) != 0 {
+		t.Errorf("expected the relationships to be valid, got %v", errs)
+	}
+}
+
+func TestGetChannelSlowmode(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","channels":[{"id":"11","guild_id":"10","rate_limit_per_user":30},{"id":"12","guild_id":"10"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if slowmode, ok := c.GetChannelSlowmode(11); !ok || slowmode != 30 {
+		t.Errorf("expected a slowmode of 30, got %d, %v", slowmode, ok)
+	}
+	if slowmode, ok := c.GetChannelSlowmode(12); !ok || slowmode != 0 {
+		t.Errorf("expected no slowmode, got %d, %v", slowmode, ok)
+	}
+	if _, ok := c.GetChannelSlowmode(13); ok {
+		t.Error("expected nothing for an uncached channel")
+	}
+}
+
+func TestGetGuildChannelPositions(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","channels":[{"id":"11","guild_id":"10","position":2},{"id":"12","guild_id":"10","position":0}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ChannelUpdate([]byte(`{"id":"12","guild_id":"10","position":5}`)); err != nil {
+		t.Fatal(err)
+	}
+	positions, err := c.GetGuildChannelPositions(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(positions, map[disgord.Snowflake]int{11: 2, 12: 5}) {
+		t.Errorf("expected the positions to match the channels, got %v", positions)
+	}
+}
+
+func TestGetGuildCreatedAt(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"175928847299117063"}`)); err != nil {
+		t.Fatal(err)
+	}
+	// This is the example snowflake from the Discord documentation.
+	created, ok := c.GetGuildCreatedAt(175928847299117063)
+	if expected := time.Unix(0, 1462015105796*int64(time.Millisecond)); !ok || !created.Equal(expected) {
+		t.Errorf("expected the guild to be created at %v, got %v", expected, created)
+	}
+	if _, ok := c.GetGuildCreatedAt(10); ok {
+		t.Error("expected nothing for an uncached guild")
+	}
+}
+
+func TestCountMembers(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","members":[{"user":{"id":"20","bot":true},"roles":["11"]},{"user":{"id":"21"},"roles":["11"]},{"user":{"id":"22"}}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	bots, err := c.CountMembers(10, func(member *disgord.Member) bool {
+		return member.User != nil && member.User.Bot
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bots != 1 {
+		t.Errorf("expected 1 bot, got %d", bots)
+	}
+	withRole, _ := c.CountMembers(10, func(member *disgord.Member) bool {
+		for _, roleID := range member.Roles {
+			if roleID == 11 {
+				return true
+			}
+		}
+		return false
+	})
+	if withRole != 2 {
+		t.Errorf("expected 2 members with the role, got %d", withRole)
+	}
+	if count, _ := c.CountMembers(12, func(*disgord.Member) bool { return true }); count != 0 {
+		t.Errorf("expected no members for an uncached guild, got %d", count)
+	}
+}
+
+func TestViewGuild(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","roles":[{"id":"11"}],"members":[{"user":{"id":"20"},"roles":["11"]}]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Members and roles are read together under the one lock, without copying.
+	var roleName string
+	if err := c.ViewGuild(10, func(guild *disgord.Guild) error {
+		if len(guild.Members) != 1 || len(guild.Roles) != 1 || guild.Members[0].Roles[0] != guild.Roles[0].ID {
+			return fmt.Errorf("expected the member to have the guild's role, got %v and %v", guild.Members, guild.Roles)
+		}
+		roleName = guild.Roles[0].Name
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+	if roleName != "" {
+		t.Errorf("expected an unnamed role, got %q", roleName)
+	}
+
+	// Errors are passed back, and the lock is released afterwards so the cache can be used again.
+	expected := fmt.Errorf("view failed")
+	if err := c.ViewGuild(10, func(*disgord.Guild) error { return expected }); err != expected {
+		t.Errorf("expected the error to be passed back, got %v", err)
+	}
+	if guild, _ := c.GetGuild(10); guild == nil {
+		t.Error("expected the guild to be readable after the view")
+	}
+
+	// The function is not called for an uncached guild.
+	if err := c.ViewGuild(12, func(*disgord.Guild) error {
+		t.Error("expected the function not to be called")
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetChannelParent(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","channels":[{"id":"11","guild_id":"10","type":4,"name":"category"},{"id":"12","guild_id":"10","parent_id":"11"},{"id":"13","guild_id":"10"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if parent, err := c.GetChannelParent(12); err != nil || parent == nil || parent.ID != 11 {
+		t.Errorf("expected the category to be the parent, got %v, %v", parent, err)
+	}
+	if parent, _ := c.GetChannelParent(13); parent != nil {
+		t.Errorf("expected no parent for a top level channel, got %v", parent)
+	}
+	if parent, _ := c.GetChannelParent(14); parent != nil {
+		t.Errorf("expected no parent for an uncached channel, got %v", parent)
+	}
+}
+
+func TestVoiceServerUpdate(t *testing.T) {
+	c := newTestCache(CacheConfig{StoreVoiceServers: true})
+	if _, err := c.VoiceServerUpdate([]byte(`{"guild_id":"10","token":"token","endpoint":"endpoint"}`)); err != nil {
+		t.Fatal(err)
+	}
+	vsu, ok := c.GetVoiceServer(10)
+	if !ok || vsu.Token != "token" || vsu.Endpoint != "endpoint" {
+		t.Fatalf("expected the voice server to be stored, got %v", vsu)
+	}
+	vsu.Token = "changed"
+	if vsu, _ := c.GetVoiceServer(10); vsu.Token != "token" {
+		t.Error("expected the voice server returned to be a copy")
+	}
+	if _, ok := c.GetVoiceServer(11); ok {
+		t.Error("expected no voice server for another guild")
+	}
+
+	// Voice servers are only kept when asked for.
+	c = newTestCache(CacheConfig{})
+	if _, err := c.VoiceServerUpdate([]byte(`{"guild_id":"10","token":"token","endpoint":"endpoint"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.GetVoiceServer(10); ok {
+		t.Error("expected the voice server not to be stored without StoreVoiceServers")
+	}
+}
+
+func TestBotVoiceStateKeepsGuildCached(t *testing.T) {
+	c := newTestCache(CacheConfig{GuildMaxItems: 2})
+	if _, err := c.Ready([]byte(`{"user":{"id":"100"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{`{"id":"10"}`, `{"id":"11"}`} {
+		if _, err := c.GuildCreate([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Guild 10 is the oldest, but joining voice there keeps it over guild 11.
+	if _, err := c.VoiceStateUpdate([]byte(`{"guild_id":"10","user_id":"100","channel_id":"20"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GuildCreate([]byte(`{"id":"12"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if guild, _ := c.GetGuild(10); guild == nil {
+		t.Error("expected the guild the bot is in voice in to survive")
+	}
+	if guild, _ := c.GetGuild(11); guild != nil {
+		t.Error("expected the other guild to be evicted instead")
+	}
+
+	// Other users joining voice do not keep a guild cached.
+	if _, err := c.VoiceStateUpdate([]byte(`{"guild_id":"12","user_id":"101","channel_id":"21"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GuildCreate([]byte(`{"id":"13"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if guild, _ := c.GetGuild(12); guild != nil {
+		t.Error("expected the guild to be evicted when only another user is in voice there")
+	}
+}
+
+func TestGetMemberJoinedAt(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","members":[{"user":{"id":"20"},"joined_at":"2020-01-02T03:04:05Z"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	joined, ok := c.GetMemberJoinedAt(10, 20)
+	if expected := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC); !ok || !joined.Equal(expected) {
+		t.Errorf("expected the member to have joined at %v, got %v", expected, joined)
+	}
+	if _, ok := c.GetMemberJoinedAt(10, 21); ok {
+		t.Error("expected nothing for an uncached member")
+	}
+	if _, ok := c.GetMemberJoinedAt(11, 20); ok {
+		t.Error("expected nothing for an uncached guild")
+	}
+}
+
+func TestChannelPinsUpdateUncachedDM(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	evt, err := c.ChannelPinsUpdate([]byte(`{"channel_id":"11","last_pin_timestamp":"2020-01-02T03:04:05Z"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evt == nil || evt.ChannelID != 11 {
+		t.Fatalf("expected the event to be returned, got %v", evt)
+	}
+	if channel, _ := c.GetChannel(11); channel != nil {
+		t.Errorf("expected the uncached channel to stay uncached, got %v", channel)
+	}
+
+	// Once the DM channel is cached, pin updates apply to it.
+	if _, err := c.ChannelCreate([]byte(`{"id":"11","type":1,"recipients":[{"id":"20"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ChannelPinsUpdate([]byte(`{"channel_id":"11","last_pin_timestamp":"2020-01-02T03:04:05Z"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if channel, _ := c.GetChannel(11); channel == nil || channel.LastPinTimestamp.IsZero() {
+		t.Errorf("expected the pin timestamp to be set on the DM channel, got %v", channel)
+	}
+}
+
+func TestForEachMember(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","members":[{"user":{"id":"20"}},{"user":{"id":"21"}},{"user":{"id":"22"}}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	if err := c.ForEachMember(10, func(*disgord.Member) bool {
+		count++
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 members, got %d", count)
+	}
+
+	count = 0
+	if err := c.ForEachMember(10, func(*disgord.Member) bool {
+		count++
+		return count < 2
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("expected iteration to stop after 2 members, got %d", count)
+	}
+
+	if err := c.ForEachMember(11, func(*disgord.Member) bool {
+		t.Error("expected no members for an uncached guild")
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetMembersPaginated(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","members":[{"user":{"id":"24"}},{"user":{"id":"20"}},{"user":{"id":"22"}},{"user":{"id":"21"}},{"user":{"id":"23"}}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	var pages [][]disgord.Snowflake
+	var after disgord.Snowflake
+	for {
+		members, err := c.GetMembersPaginated(10, after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(members) == 0 {
+			break
+		}
+		var page []disgord.Snowflake
+		for _, member := range members {
+			page = append(page, member.UserID)
+		}
+		pages = append(pages, page)
+		after = page[len(page)-1]
+	}
+	if expected := [][]disgord.Snowflake{{20, 21}, {22, 23}, {24}}; !reflect.DeepEqual(pages, expected) {
+		t.Errorf("expected the pages %v, got %v", expected, pages)
+	}
+	if members, _ := c.GetMembersPaginated(10, 0, 0); len(members) != 5 {
+		t.Errorf("expected every member without a limit, got %d", len(members))
+	}
+}
+
+func TestGuildDeleteWithoutGuild(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10"}`)); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{`{}`, `null`} {
+		evt, err := c.GuildDelete([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if evt == nil {
+			t.Fatalf("expected an event for %s", data)
+		}
+	}
+	if guild, _ := c.GetGuild(10); guild == nil {
+		t.Error("expected the cached guild to be left alone")
+	}
+}
+
+// Used to fill every store of a cache for the flush tests.
+func populateCache(t *testing.T, c *cache) {
+	t.Helper()
+	if _, err := c.GuildCreate([]byte(`{"id":"10","channels":[{"id":"11","guild_id":"10"}],"voice_states":[{"user_id":"20","channel_id":"11"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GuildMemberAdd([]byte(`{"guild_id":"10","user":{"id":"20"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	createMessage(t, c, 11, 100)
+}
+
+func TestFlushes(t *testing.T) {
+	type present struct {
+		guild, channel, user, voiceState, message bool
+	}
+	check := func(c *cache) present {
+		guild, _ := c.GetGuild(10)
+		channel, _ := c.GetChannel(11)
+		user, _ := c.GetUser(20)
+		state, _ := c.GetVoiceState(10, 20)
+		msg, _ := c.GetMessage(11, 100)
+		return present{guild != nil, channel != nil, user != nil, state != nil, msg != nil}
+	}
+	for name, tc := range map[string]struct {
+		flush    func(c *cache)
+		expected present
+	}{
+		"guilds":       {(*cache).FlushGuilds, present{false, true, true, true, true}},
+		"channels":     {(*cache).FlushChannels, present{true, false, true, true, true}},
+		"users":        {(*cache).FlushUsers, present{true, true, false, true, true}},
+		"voice states": {(*cache).FlushVoiceStates, present{true, true, true, false, true}},
+		"messages":     {(*cache).FlushMessages, present{true, true, true, true, false}},
+	} {
+		c := newTestCache(CacheConfig{MessageMaxItems: 10})
+		populateCache(t, c)
+		tc.flush(c)
+		if got := check(c); got != tc.expected {
+			t.Errorf("expected flushing the %s to leave %+v, got %+v", name, tc.expected, got)
+		}
+	}
+}
+
+func TestGetVoiceChannelUserIDs(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	for _, data := range []string{
+		`{"guild_id":"10","user_id":"22","channel_id":"11"}`,
+		`{"guild_id":"10","user_id":"20","channel_id":"11"}`,
+		`{"guild_id":"10","user_id":"21","channel_id":"12"}`,
+		`{"guild_id":"13","user_id":"23","channel_id":"11"}`,
+	} {
+		if _, err := c.VoiceStateUpdate([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids, err := c.GetVoiceChannelUserIDs(10, 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []disgord.Snowflake{20, 22}) {
+		t.Errorf("expected users 20 and 22 in the channel, got %v", ids)
+	}
+	if ids, _ := c.GetVoiceChannelUserIDs(10, 14); len(ids) != 0 {
+		t.Errorf("expected nobody in an empty channel, got %v", ids)
+	}
+}
+
+func TestGetGuildEmojisOk(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if emojis, ok := c.GetGuildEmojisOk(10); emojis == nil || len(emojis) != 0 || ok {
+		t.Errorf("expected an empty slice and false for a missing guild, got %v, %v", emojis, ok)
+	}
+	if _, err := c.GuildCreate([]byte(`{"id":"10"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if emojis, ok := c.GetGuildEmojisOk(10); emojis == nil || len(emojis) != 0 || !ok {
+		t.Errorf("expected an empty slice and true for a guild without emojis, got %v, %v", emojis, ok)
+	}
+	if emojis, _ := c.GetGuildEmojis(10); emojis == nil {
+		t.Error("expected GetGuildEmojis to return an empty slice for a guild without emojis")
+	}
+}
+
+func TestIsChannelNSFW(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","channels":[{"id":"11","guild_id":"10","nsfw":true},{"id":"12","guild_id":"10"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if nsfw, ok := c.IsChannelNSFW(11); !ok || !nsfw {
+		t.Errorf("expected channel 11 to be NSFW, got %v, %v", nsfw, ok)
+	}
+	if nsfw, ok := c.IsChannelNSFW(12); !ok || nsfw {
+		t.Errorf("expected channel 12 not to be NSFW, got %v, %v", nsfw, ok)
+	}
+	if _, ok := c.IsChannelNSFW(13); ok {
+		t.Error("expected nothing for an uncached channel")
+	}
+}
+
+func TestGuildUpdateChangeCallbacks(t *testing.T) {
+	var rolesChanged, emojisChanged int
+	c := newTestCache(CacheConfig{
+		OnRolesChanged: func(disgord.Snowflake) {
+			rolesChanged++
+		},
+		OnEmojisChanged: func(disgord.Snowflake) {
+			emojisChanged++
+		},
+	})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","roles":[{"id":"11","name":"role"}],"emojis":[{"id":"12","name":"emoji"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		data          string
+		roles, emojis int
+	}{
+		{`{"id":"10","name":"renamed","roles":[{"id":"11","name":"role"}],"emojis":[{"id":"12","name":"emoji"}]}`, 0, 0},
+		{`{"id":"10","roles":[{"id":"11","name":"renamed"}],"emojis":[{"id":"12","name":"emoji"}]}`, 1, 0},
+		{`{"id":"10","roles":[{"id":"11","name":"renamed"}],"emojis":[{"id":"12","name":"renamed"}]}`, 1, 1},
+		{`{"id":"10","roles":[],"emojis":[]}`, 2, 2},
+	} {
+		if _, err := c.GuildUpdate([]byte(tc.data)); err != nil {
+			t.Fatal(err)
+		}
+		if rolesChanged != tc.roles || emojisChanged != tc.emojis {
+			t.Errorf("expected %d role and %d emoji callbacks after %s, got %d and %d", tc.roles, tc.emojis, tc.data, rolesChanged, emojisChanged)
+		}
+	}
+}
+
+func TestMaxVoiceStatesPerGuild(t *testing.T) {
+	c := newTestCache(CacheConfig{MaxVoiceStatesPerGuild: 3})
+	for userID := 20; userID < 30; userID++ {
+		if _, err := c.VoiceStateUpdate([]byte(fmt.Sprintf(`{"guild_id":"10","user_id":"%d","channel_id":"11"}`, userID))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, _ := c.GuildVoiceStateCount(10); count != 3 {
+		t.Errorf("expected the guild to be capped at 3 voice states, got %d", count)
+	}
+	// The least recently updated voice states are the ones dropped.
+	ids, _ := c.GetVoiceChannelUserIDs(10, 11)
+	if !reflect.DeepEqual(ids, []disgord.Snowflake{27, 28, 29}) {
+		t.Errorf("expected the newest voice states to be kept, got %v", ids)
+	}
+
+	// Other guilds have their own cap.
+	if _, err := c.VoiceStateUpdate([]byte(`{"guild_id":"12","user_id":"20","channel_id":"13"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if count := c.VoiceStateCount(); count != 4 {
+		t.Errorf("expected 4 voice states across the guilds, got %d", count)
+	}
+}
+
+func TestValidateRelationships(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","channels":[{"id":"11","guild_id":"10"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GuildCreate([]byte(`{"id":"12","channels":[{"id":"13","guild_id":"12"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if errs := c.ValidateRelationships(); len(errs) != 0 {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+
+	// Register channel 11 under guild 12 as well, which also does not match its guild ID.
+	c.ChannelMu.Lock()
+	c.registerChannelRelationship(12, 11)
+	c.ChannelMu.Unlock()
+	errs := c.ValidateRelationships()
+	expected := []string{
+		"disgordtlru: channel 11 is registered under guilds 10 and 12",
+		"disgordtlru: channel 11 is registered under guild 12 but belongs to guild 10",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %v", len(expected), errs)
+	}
+	for i, err := range errs {
+		if err.Error() != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], err)
+		}
+	}
+}
+
+func TestGetGuildRolesWithoutEmojis(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","roles":[{"id":"10","name":"a"},{"id":"11","name":"b"},{"id":"12","name":"c"},{"id":"13","name":"d"},{"id":"14","name":"e"}],"emojis":[]}`)); err != nil {
+		t.Fatal(err)
+	}
+	roles, err := c.GetGuildRoles(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 5 {
+		t.Fatalf("expected 5 roles, got %d", len(roles))
+	}
+	for i, role := range roles {
+		if role == nil {
+			t.Fatalf("expected role %d to be set", i)
+		}
+		role.Name = "changed"
+	}
+	roles, _ = c.GetGuildRoles(10)
+	for _, role := range roles {
+		if role.Name == "changed" {
+			t.Errorf("expected the roles to be copies, but role %s was changed in the cache", role.ID)
+		}
+	}
+}
+
+func TestGetGuildRoleByPosition(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","roles":[{"id":"10","position":0},{"id":"11","position":1},{"id":"13","position":2},{"id":"12","position":2}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	// Ties on position go to the lowest ID.
+	for position, expected := range map[int]disgord.Snowflake{0: 10, 1: 11, 2: 12} {
+		role, err := c.GetGuildRoleByPosition(10, position)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if role == nil || role.ID != expected {
+			t.Errorf("expected the role at position %d to be %s, got %v", position, expected, role)
+		}
+	}
+	if role, _ := c.GetGuildRoleByPosition(10, 3); role != nil {
+		t.Errorf("expected no role at an unused position, got %v", role)
+	}
+	if role, _ := c.GetGuildRoleByPosition(20, 0); role != nil {
+		t.Errorf("expected no role for an uncached guild, got %v", role)
+	}
+}
+
+func TestGetMemberReturnsCopy(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","members":[{"user":{"id":"20","username":"a"},"nick":"before","roles":["11"]}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	member, err := c.GetMember(10, 20)
+	if err != nil || member == nil {
+		t.Fatalf("expected the member, got %v (%v)", member, err)
+	}
+	member.Nick = "after"
+	member.Roles[0] = 12
+	member.User.Username = "b"
+	member, _ = c.GetMember(10, 20)
+	if member.Nick != "before" || member.Roles[0] != 11 || member.User.Username != "a" {
+		t.Errorf("expected the cached member to be unchanged, got %+v", member)
+	}
+}
+
+func TestGetGuildMemberIDs(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","members":[{"user":{"id":"21"}}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{
+		`{"guild_id":"10","user":{"id":"23"}}`,
+		`{"guild_id":"10","user":{"id":"20"}}`,
+		`{"guild_id":"10","user":{"id":"22"}}`,
+	} {
+		if _, err := c.GuildMemberAdd([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.GuildMemberRemove([]byte(`{"guild_id":"10","user":{"id":"22"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := c.GetGuildMemberIDs(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []disgord.Snowflake{20, 21, 23}) {
+		t.Errorf("expected the members 20, 21 and 23, got %v", ids)
+	}
+	if ids, _ := c.GetGuildMemberIDs(11); ids != nil {
+		t.Errorf("expected no ID's for an uncached guild, got %v", ids)
+	}
+}
+
+func TestMinimalGuildCreate(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10"}`)); err != nil {
+		t.Fatal(err)
+	}
+	roles, err := c.GetGuildRoles(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roles == nil || len(roles) != 0 {
+		t.Errorf("expected an empty non-nil role slice, got %#v", roles)
+	}
+	emojis, err := c.GetGuildEmojis(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emojis == nil || len(emojis) != 0 {
+		t.Errorf("expected an empty non-nil emoji slice, got %#v", emojis)
+	}
+	if role, _ := c.GetGuildRole(10, 11); role != nil {
+		t.Errorf("expected no role, got %v", role)
+	}
+	if emoji, _ := c.GetGuildEmoji(10, 11); emoji != nil {
+		t.Errorf("expected no emoji, got %v", emoji)
+	}
+
+	// A later event fills in what was missing.
+	if _, err := c.GuildRoleCreate([]byte(`{"guild_id":"10","role":{"id":"11"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GuildEmojisUpdate([]byte(`{"guild_id":"10","emojis":[{"id":"12"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if roles, _ := c.GetGuildRoles(10); len(roles) != 1 || roles[0].ID != 11 {
+		t.Errorf("expected role 11 after the role create, got %v", roles)
+	}
+	if emojis, _ := c.GetGuildEmojis(10); len(emojis) != 1 || emojis[0].ID != 12 {
+		t.Errorf("expected emoji 12 after the emojis update, got %v", emojis)
+	}
+}
+
+func TestGetUserFlags(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildMemberAdd([]byte(`{"guild_id":"10","user":{"id":"20","public_flags":65536}}`)); err != nil {
+		t.Fatal(err)
+	}
+	c.Users.Lock()
+	c.setUser(&disgord.User{ID: 21, PublicFlags: 4096})
+	c.Users.Unlock()
+	for userID, expected := range map[disgord.Snowflake]disgord.UserFlag{20: 65536, 21: 4096} {
+		flags, ok := c.GetUserFlags(userID)
+		if !ok || flags != expected {
+			t.Errorf("expected user %s to have flags %d, got %d (%v)", userID, expected, flags, ok)
+		}
+	}
+	if _, ok := c.GetUserFlags(22); ok {
+		t.Error("expected no flags for an uncached user")
+	}
+}
+
+func TestGuildMembersChunks(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","member_count":4,"members":[{"user":{"id":"20"}}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{
+		`{"guild_id":"10","chunk_index":0,"chunk_count":2,"members":[{"user":{"id":"20","username":"a"},"nick":"x"},{"user":{"id":"21","username":"b"}}]}`,
+		`{"guild_id":"10","chunk_index":1,"chunk_count":2,"members":[{"user":{"id":"22","username":"c"}},{"user":{"id":"23","username":"d"}}]}`,
+	} {
+		if _, err := c.GuildMembersChunk([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids, _ := c.GetGuildMemberIDs(10)
+	if !reflect.DeepEqual(ids, []disgord.Snowflake{20, 21, 22, 23}) {
+		t.Errorf("expected the members 20 to 23 once each, got %v", ids)
+	}
+	for _, userID := range ids {
+		if member, _ := c.GetMember(10, userID); member == nil {
+			t.Errorf("expected member %s to be retrievable", userID)
+		}
+		if user, _ := c.GetUser(userID); user == nil {
+			t.Errorf("expected user %s to be cached", userID)
+		}
+	}
+	if member, _ := c.GetMember(10, 20); member.Nick != "x" {
+		t.Errorf("expected the chunk to update member 20, got %+v", member)
+	}
+	// The chunks hold members which already count towards the guild.
+	if guild, _ := c.GetGuild(10); guild.MemberCount != 4 {
+		t.Errorf("expected the member count to stay at 4, got %d", guild.MemberCount)
+	}
+}
+
+func TestSortedResults(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","members":[{"user":{"id":"24"}},{"user":{"id":"21"}},{"user":{"id":"23"}},{"user":{"id":"20"}},{"user":{"id":"22"}}],"voice_states":[{"user_id":"23","channel_id":"11"},{"user_id":"20","channel_id":"11"},{"user_id":"22","channel_id":"11"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	// Removing a member swaps the last member into its place.
+	if _, err := c.GuildMemberRemove([]byte(`{"guild_id":"10","user":{"id":"21"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if ids, _ := c.GetGuildMemberIDs(10); !reflect.DeepEqual(ids, []disgord.Snowflake{20, 22, 23, 24}) {
+			t.Errorf("expected the member ID's in ascending order, got %v", ids)
+		}
+		if ids, _ := c.GetVoiceChannelUserIDs(10, 11); !reflect.DeepEqual(ids, []disgord.Snowflake{20, 22, 23}) {
+			t.Errorf("expected the voice channel user ID's in ascending order, got %v", ids)
+		}
+		states, _ := c.GetGuildVoiceStates(10)
+		var ids []disgord.Snowflake
+		for _, state := range states {
+			ids = append(ids, state.UserID)
+		}
+		if !reflect.DeepEqual(ids, []disgord.Snowflake{20, 22, 23}) {
+			t.Errorf("expected the voice states sorted by user ID, got %v", ids)
+		}
+	}
+}
+
+func TestGetGuildChannelsDanglingRelationship(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","channels":[{"id":"11","name":"a"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	c.ChannelMu.Lock()
+	c.registerChannelRelationship(10, 12)
+	c.ChannelMu.Unlock()
+	channels, err := c.GetGuildChannels(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 1 || channels[0].ID != 11 {
+		t.Errorf("expected only channel 11, got %v", channels)
+	}
+}
+
+func TestChannelUpdatePresentFields(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.ChannelCreate([]byte(`{"id":"11","guild_id":"10","name":"a","topic":"b","permission_overwrites":[{"id":"12","type":"role","allow":1024}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ChannelUpdate([]byte(`{"id":"11","name":"c"}`)); err != nil {
+		t.Fatal(err)
+	}
+	channel, _ := c.GetChannel(11)
+	if channel.Name != "c" || channel.Topic != "b" || len(channel.PermissionOverwrites) != 1 {
+		t.Errorf("expected only the name to change, got %+v", channel)
+	}
+	if _, err := c.ChannelUpdate([]byte(`{"id":"11","permission_overwrites":[]}`)); err != nil {
+		t.Fatal(err)
+	}
+	channel, _ = c.GetChannel(11)
+	if len(channel.PermissionOverwrites) != 0 {
+		t.Errorf("expected the overwrites to be cleared, got %v", channel.PermissionOverwrites)
+	}
+	if channel.Name != "c" || channel.Topic != "b" {
+		t.Errorf("expected the other fields to be kept, got %+v", channel)
+	}
+}
+
+func TestSetChannel(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	seed := &disgord.Channel{ID: 11, GuildID: 10, Name: "a"}
+	c.SetChannel(seed)
+	seed.Name = "changed"
+	channel, _ := c.GetChannel(11)
+	if channel == nil || channel.Name != "a" {
+		t.Fatalf("expected the channel to be inserted as a copy, got %v", channel)
+	}
+	if channels, _ := c.GetGuildChannels(10); len(channels) != 1 || channels[0].ID != 11 {
+		t.Errorf("expected the channel to be registered under its guild, got %v", channels)
+	}
+
+	if _, err := c.ChannelUpdate([]byte(`{"id":"11","topic":"b","last_message_id":"20"}`)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetChannel(&disgord.Channel{ID: 11, GuildID: 10, Name: "c"})
+	channel, _ = c.GetChannel(11)
+	if channel.Name != "c" || channel.Topic != "b" || channel.LastMessageID != 20 {
+		t.Errorf("expected the seed to be merged over the gateway fields, got %+v", channel)
+	}
+	if channels, _ := c.GetGuildChannels(10); len(channels) != 1 {
+		t.Errorf("expected the channel to be registered once, got %v", channels)
+	}
+}
+
+// Defines a metrics hook which records every call.
+type testMetricsHook struct {
+	calls []string
+}
+
+func (h *testMetricsHook) ObserveGet(cacheType string, hit bool) {
+	h.calls = append(h.calls, fmt.Sprintf("get %s %v", cacheType, hit))
+}
+
+func (h *testMetricsHook) ObserveSet(cacheType string) {
+	h.calls = append(h.calls, "set "+cacheType)
+}
+
+func TestMetricsHook(t *testing.T) {
+	hook := &testMetricsHook{}
+	c := newTestCache(CacheConfig{MetricsHook: hook})
+	if user, _ := c.GetUser(20); user != nil {
+		t.Fatalf("expected user 20 to be missing, got %v", user)
+	}
+	c.Users.Lock()
+	c.setUser(&disgord.User{ID: 20})
+	c.Users.Unlock()
+	if user, _ := c.GetUser(20); user == nil {
+		t.Fatal("expected user 20 to be cached")
+	}
+	expected := []string{"get user false", "set user", "get user true"}
+	if !reflect.DeepEqual(hook.calls, expected) {
+		t.Errorf("expected the calls %v, got %v", expected, hook.calls)
+	}
+}
+
+func TestGetGuilds(t *testing.T) {
+	c := newTestCache(CacheConfig{DoNotReturnGetGuildMembers: true})
+	for _, data := range []string{
+		`{"id":"10","name":"a","members":[{"user":{"id":"20"}}],"channels":[{"id":"12"}]}`,
+		`{"id":"11","name":"b"}`,
+	} {
+		if _, err := c.GuildCreate([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	guilds, err := c.GetGuilds([]disgord.Snowflake{10, 13, 11, 14})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(guilds) != 2 || guilds[10] == nil || guilds[11] == nil {
+		t.Fatalf("expected only guilds 10 and 11, got %v", guilds)
+	}
+	if guilds[10].Name != "a" || guilds[11].Name != "b" {
+		t.Errorf("expected the guilds to be keyed by their ID, got %v", guilds)
+	}
+	if len(guilds[10].Members) != 0 {
+		t.Errorf("expected no members since they are not returned, got %v", guilds[10].Members)
+	}
+	if len(guilds[10].Channels) != 1 || guilds[10].Channels[0].ID != 12 {
+		t.Errorf("expected guild 10 to have channel 12, got %v", guilds[10].Channels)
+	}
+	guilds[11].Name = "changed"
+	if guild, _ := c.GetGuild(11); guild.Name != "b" {
+		t.Errorf("expected the guilds to be copies, got %q", guild.Name)
+	}
+}
+
+func TestGetChannelOverwriteFor(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.ChannelCreate([]byte(`{"id":"11","guild_id":"10","permission_overwrites":[{"id":"12","type":"role","allow":1024},{"id":"20","type":"member","deny":2048}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	overwrite, err := c.GetChannelOverwriteFor(11, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overwrite == nil || overwrite.Type != "role" || overwrite.Allow != 1024 {
+		t.Errorf("expected the role overwrite, got %v", overwrite)
+	}
+	overwrite, _ = c.GetChannelOverwriteFor(11, 20)
+	if overwrite == nil || overwrite.Type != "member" || overwrite.Deny != 2048 {
+		t.Errorf("expected the member overwrite, got %v", overwrite)
+	}
+	overwrite.Deny = 0
+	if overwrite, _ := c.GetChannelOverwriteFor(11, 20); overwrite.Deny != 2048 {
+		t.Error("expected the overwrite to be a copy")
+	}
+	if overwrite, err := c.GetChannelOverwriteFor(11, 21); overwrite != nil || err != nil {
+		t.Errorf("expected no overwrite, got %v (%v)", overwrite, err)
+	}
+	if overwrite, _ := c.GetChannelOverwriteFor(13, 12); overwrite != nil {
+		t.Errorf("expected no overwrite for an uncached channel, got %v", overwrite)
+	}
+}
+
+func TestCopyGuildWithoutMembersKeepsCache(t *testing.T) {
+	c := newTestCache(CacheConfig{DoNotReturnGetGuildMembers: true})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","members":[{"user":{"id":"20"}},{"user":{"id":"21"}}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	guild, _ := c.GetGuild(10)
+	if len(guild.Members) != 0 {
+		t.Errorf("expected the copy to have no members, got %v", guild.Members)
+	}
+	c.GetGuilds([]disgord.Snowflake{10})
+	c.GetAllGuilds()
+	err := c.ViewGuild(10, func(guild *disgord.Guild) error {
+		if len(guild.Members) != 2 {
+			t.Errorf("expected the cached guild to keep both members, got %v", guild.Members)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if member, _ := c.GetMember(10, 21); member == nil {
+		t.Error("expected member 21 to still be cached")
+	}
+}
+
+func TestGetGuildChannelByName(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","channels":[{"id":"11","name":"general","position":2},{"id":"12","name":"general","position":1},{"id":"13","name":"logs","position":0}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	channel, err := c.GetGuildChannelByName(10, "general")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The lowest position wins when several channels share a name.
+	if channel == nil || channel.ID != 12 {
+		t.Errorf("expected channel 12, got %v", channel)
+	}
+	if channel, _ := c.GetGuildChannelByName(10, "logs"); channel == nil || channel.ID != 13 {
+		t.Errorf("expected channel 13, got %v", channel)
+	}
+	if channel, err := c.GetGuildChannelByName(10, "missing"); channel != nil || err != nil {
+		t.Errorf("expected no channel, got %v (%v)", channel, err)
+	}
+	if channel, _ := c.GetGuildChannelByName(14, "general"); channel != nil {
+		t.Errorf("expected no channel for an uncached guild, got %v", channel)
+	}
+}
+
+// Used to get the channels registered under a guild, in order.
+func channelRelationships(c *cache, guildId disgord.Snowflake) []disgord.Snowflake {
+	relationships, ok := c.GuildChannelRelationship[guildId]
+	if !ok {
+		return nil
+	}
+	var ids []disgord.Snowflake
+	for x := relationships.Front(); x != nil; x = x.Next() {
+		ids = append(ids, x.Value.(disgord.Snowflake))
+	}
+	return ids
+}
+
+func TestDestroyChannelRelationship(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	c.ChannelMu.Lock()
+	defer c.ChannelMu.Unlock()
+	c.registerChannelRelationship(10, 11)
+	c.destroyChannelRelationship(10, 11)
+	if _, ok := c.GuildChannelRelationship[10]; ok {
+		t.Error("expected removing the only channel to remove the relationship list")
+	}
+
+	for _, channelId := range []disgord.Snowflake{11, 12, 13} {
+		c.registerChannelRelationship(10, channelId)
+	}
+	c.destroyChannelRelationship(10, 12)
+	if ids := channelRelationships(c, 10); !reflect.DeepEqual(ids, []disgord.Snowflake{11, 13}) {
+		t.Errorf("expected channels 11 and 13 to remain, got %v", ids)
+	}
+	c.destroyChannelRelationship(10, 14)
+	if ids := channelRelationships(c, 10); !reflect.DeepEqual(ids, []disgord.Snowflake{11, 13}) {
+		t.Errorf("expected removing a missing channel to change nothing, got %v", ids)
+	}
+	c.destroyChannelRelationship(15, 11)
+	if _, ok := c.GuildChannelRelationship[15]; ok {
+		t.Error("expected no relationship list to be created for another guild")
+	}
+}
+
+func TestVoiceStateCounts(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	for _, data := range []string{
+		`{"guild_id":"10","user_id":"20","channel_id":"11"}`,
+		`{"guild_id":"10","user_id":"21","channel_id":"11"}`,
+		`{"guild_id":"12","user_id":"20","channel_id":"13"}`,
+		// Moving channels is not a new voice state.
+		`{"guild_id":"10","user_id":"21","channel_id":"14"}`,
+	} {
+		if _, err := c.VoiceStateUpdate([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := c.VoiceStateCount(); count != 3 {
+		t.Errorf("expected 3 voice states, got %d", count)
+	}
+	if count, ok := c.GuildVoiceStateCount(10); !ok || count != 2 {
+		t.Errorf("expected 2 voice states in guild 10, got %d (%v)", count, ok)
+	}
+
+	if _, err := c.VoiceStateUpdate([]byte(`{"guild_id":"10","user_id":"20","channel_id":null}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.VoiceStateUpdate([]byte(`{"guild_id":"12","user_id":"20","channel_id":null}`)); err != nil {
+		t.Fatal(err)
+	}
+	if count := c.VoiceStateCount(); count != 1 {
+		t.Errorf("expected 1 voice state after the leaves, got %d", count)
+	}
+	if count, ok := c.GuildVoiceStateCount(10); !ok || count != 1 {
+		t.Errorf("expected 1 voice state in guild 10, got %d (%v)", count, ok)
+	}
+	if count, ok := c.GuildVoiceStateCount(12); ok || count != 0 {
+		t.Errorf("expected no voice states in guild 12, got %d (%v)", count, ok)
+	}
+}
+
+func TestClear(t *testing.T) {
+	c := newTestCache(CacheConfig{MessageMaxItems: 10})
+	populateCache(t, c)
+	if _, err := c.Ready([]byte(`{"user":{"id":"30","username":"bot"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	c.Clear()
+
+	if guild, _ := c.GetGuild(10); guild != nil {
+		t.Errorf("expected no guild, got %v", guild)
+	}
+	if channel, _ := c.GetChannel(11); channel != nil {
+		t.Errorf("expected no channel, got %v", channel)
+	}
+	if channels, _ := c.GetGuildChannels(10); channels != nil {
+		t.Errorf("expected no guild channels, got %v", channels)
+	}
+	if user, _ := c.GetUser(20); user != nil {
+		t.Errorf("expected no user, got %v", user)
+	}
+	if member, _ := c.GetMember(10, 20); member != nil {
+		t.Errorf("expected no member, got %v", member)
+	}
+	if state, _ := c.GetVoiceState(10, 20); state != nil {
+		t.Errorf("expected no voice state, got %v", state)
+	}
+	if states, _ := c.GetGuildVoiceStates(10); len(states) != 0 {
+		t.Errorf("expected no guild voice states, got %v", states)
+	}
+	if msg, _ := c.GetMessage(11, 100); msg != nil {
+		t.Errorf("expected no message, got %v", msg)
+	}
+	if user, _ := c.GetCurrentUser(); user == nil || user.ID != 0 || user.Username != "" {
+		t.Errorf("expected the current user to be reset, got %v", user)
+	}
+	if len(c.GuildChannelRelationship) != 0 || len(c.GuildVoiceStateRelationship) != 0 {
+		t.Error("expected the relationships to be cleared")
+	}
+}
+
+func TestPostHandlerSeesUpdatedCache(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	var names []string
+	c.RegisterPostHandler(disgord.EvtGuildUpdate, func(cache CacheReader, data []byte) {
+		// This would deadlock if the guild lock were still held.
+		guild, _ := cache.GetGuild(10)
+		if guild == nil {
+			t.Error("expected the guild to be cached in the post handler")
+			return
+		}
+		names = append(names, guild.Name)
+	})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","name":"a"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GuildUpdate([]byte(`{"id":"10","name":"b"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GuildUpdate([]byte(`{"id":`)); err == nil {
+		t.Fatal("expected the broken update to fail")
+	}
+	if !reflect.DeepEqual(names, []string{"b"}) {
+		t.Errorf("expected the post handler to run once and see the new name, got %v", names)
+	}
+}
+
+func TestReadsKeepEntriesCached(t *testing.T) {
+	c := newTestCache(CacheConfig{GuildDuration: time.Minute, UserDuration: time.Minute})
+	clock := useTestClock(c)
+	if _, err := c.GuildCreate([]byte(`{"id":"10"}`)); err != nil {
+		t.Fatal(err)
+	}
+	c.Users.Lock()
+	c.setUser(&disgord.User{ID: 20})
+	c.Users.Unlock()
+	for i := 0; i < 3; i++ {
+		clock.advance(time.Minute - time.Second)
+		if guild, _ := c.GetGuild(10); guild == nil {
+			t.Fatalf("expected the guild to survive read %d", i)
+		}
+		if user, _ := c.GetUser(20); user == nil {
+			t.Fatalf("expected the user to survive read %d", i)
+		}
+	}
+	clock.advance(time.Minute)
+	if guild, _ := c.GetGuild(10); guild != nil {
+		t.Error("expected the guild to expire once it is no longer read")
+	}
+	if user, _ := c.GetUser(20); user != nil {
+		t.Error("expected the user to expire once it is no longer read")
+	}
+}
+
+func TestGuildBanAdd(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","member_count":3,"members":[{"user":{"id":"20"}},{"user":{"id":"21"}}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	evt, err := c.GuildBanAdd([]byte(`{"guild_id":"10","user":{"id":"20"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evt.User == nil || evt.User.ID != 20 {
+		t.Errorf("expected the event for user 20, got %+v", evt)
+	}
+	if member, _ := c.GetMember(10, 20); member != nil {
+		t.Errorf("expected the banned member to be removed, got %v", member)
+	}
+	if guild, _ := c.GetGuild(10); guild.MemberCount != 2 {
+		t.Errorf("expected the member count to drop to 2, got %d", guild.MemberCount)
+	}
+	// The member remove Discord sends alongside the ban must not decrement the count again.
+	if _, err := c.GuildMemberRemove([]byte(`{"guild_id":"10","user":{"id":"20"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if guild, _ := c.GetGuild(10); guild.MemberCount != 2 {
+		t.Errorf("expected the member count to stay at 2, got %d", guild.MemberCount)
+	}
+
+	if _, err := c.GuildBanAdd([]byte(`{"guild_id":"10","user":{"id":"22"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if guild, _ := c.GetGuild(10); guild.MemberCount != 2 || len(guild.Members) != 1 {
+		t.Errorf("expected banning an uncached member to change nothing, got %d members counted and %v cached", guild.MemberCount, guild.Members)
+	}
+	if _, err := c.GuildBanRemove([]byte(`{"guild_id":"10","user":{"id":"20"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if member, _ := c.GetMember(10, 20); member != nil {
+		t.Errorf("expected an unban not to add the member back, got %v", member)
+	}
+}
+
+func TestGetGuildBotJoinedAt(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","joined_at":"2020-08-23T15:10:40.000000+00:00"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GuildCreate([]byte(`{"id":"11"}`)); err != nil {
+		t.Fatal(err)
+	}
+	joinedAt, ok := c.GetGuildBotJoinedAt(10)
+	if expected := time.Date(2020, 8, 23, 15, 10, 40, 0, time.UTC); !ok || !joinedAt.Equal(expected) {
+		t.Errorf("expected the bot to have joined at %v, got %v (%v)", expected, joinedAt, ok)
+	}
+	// An update does not carry joined_at, so it must be kept.
+	if _, err := c.GuildUpdate([]byte(`{"id":"10","name":"a"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if joinedAt, ok := c.GetGuildBotJoinedAt(10); !ok || joinedAt.IsZero() {
+		t.Errorf("expected the join time to survive an update, got %v (%v)", joinedAt, ok)
+	}
+	if _, ok := c.GetGuildBotJoinedAt(11); ok {
+		t.Error("expected no join time for a guild create without one")
+	}
+	if _, ok := c.GetGuildBotJoinedAt(12); ok {
+		t.Error("expected no join time for an uncached guild")
+	}
+}
+
+func TestGuildCreateMerges(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","name":"a","member_count":2,"members":[{"user":{"id":"20"},"nick":"x"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GuildMemberAdd([]byte(`{"guild_id":"10","user":{"id":"21"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GuildUpdate([]byte(`{"id":"10","name":"b","region":"europe"}`)); err != nil {
+		t.Fatal(err)
+	}
+	// A second create, such as after a resume, is merged over what is cached.
+	if _, err := c.GuildCreate([]byte(`{"id":"10","name":"c","members":[{"user":{"id":"20"},"nick":"y"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	guild, _ := c.GetGuild(10)
+	if guild.Name != "c" || guild.Region != "europe" {
+		t.Errorf("expected the create to be merged over the update, got %q in %q", guild.Name, guild.Region)
+	}
+	if ids, _ := c.GetGuildMemberIDs(10); !reflect.DeepEqual(ids, []disgord.Snowflake{20, 21}) {
+		t.Errorf("expected members 20 and 21 once each, got %v", ids)
+	}
+	if member, _ := c.GetMember(10, 20); member.Nick != "y" {
+		t.Errorf("expected the member from the create to take priority, got %q", member.Nick)
+	}
+}
+
+func TestGuildCreateBecomesAvailable(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","unavailable":true}`)); err != nil {
+		t.Fatal(err)
+	}
+	if guild, _ := c.GetGuild(10); guild == nil || !guild.Unavailable {
+		t.Fatalf("expected an unavailable guild, got %v", guild)
+	}
+	if _, err := c.GuildCreate([]byte(`{"id":"10","name":"a","members":[{"user":{"id":"20"}}],"channels":[{"id":"11"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	guild, _ := c.GetGuild(10)
+	if guild.Unavailable || guild.Name != "a" {
+		t.Errorf("expected the guild to become available, got %+v", guild)
+	}
+	if member, _ := c.GetMember(10, 20); member == nil {
+		t.Error("expected the members of the available guild to be cached")
+	}
+	if channels, _ := c.GetGuildChannels(10); len(channels) != 1 {
+		t.Errorf("expected the channels of the available guild to be cached, got %v", channels)
+	}
+}
+
+func TestGetChannelRecipients(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	for _, data := range []string{
+		`{"id":"11","type":3,"recipients":[{"id":"20","username":"a"},{"id":"21","username":"b"},{"id":"22","username":"c"}]}`,
+		`{"id":"12","type":0,"guild_id":"10"}`,
+	} {
+		if _, err := c.ChannelCreate([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recipients, err := c.GetChannelRecipients(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []disgord.Snowflake
+	for _, recipient := range recipients {
+		ids = append(ids, recipient.ID)
+	}
+	if !reflect.DeepEqual(ids, []disgord.Snowflake{20, 21, 22}) {
+		t.Errorf("expected recipients 20, 21 and 22, got %v", ids)
+	}
+	recipients[0].Username = "changed"
+	if recipients, _ := c.GetChannelRecipients(11); recipients[0].Username != "a" {
+		t.Error("expected the recipients to be copies")
+	}
+	if recipients, err := c.GetChannelRecipients(12); recipients != nil || err != nil {
+		t.Errorf("expected no recipients for a guild channel, got %v (%v)", recipients, err)
+	}
+	if recipients, _ := c.GetChannelRecipients(13); recipients != nil {
+		t.Errorf("expected no recipients for an uncached channel, got %v", recipients)
+	}
+}
+
+func TestGuildUpdateConcurrently(t *testing.T) {
+	var changes int32
+	c := newTestCache(CacheConfig{
+		OnRolesChanged: func(guildID disgord.Snowflake) {
+			atomic.AddInt32(&changes, 1)
+		},
+	})
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	deleted := make(chan struct{})
+	go func() {
+		// Deleting the guild means more of the updates become the cached guild, which the other updates then decode into.
+		defer close(deleted)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.GuildDelete([]byte(`{"id":"10"}`))
+			}
+		}
+	}()
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				data := fmt.Sprintf(`{"id":"10","name":"%d","roles":[{"id":"%d"}]}`, j, 10+i)
+				if _, err := c.GuildUpdate([]byte(data)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	<-deleted
+	if atomic.LoadInt32(&changes) == 0 {
+		t.Error("expected the role changes to be reported")
+	}
+}
+
+func TestGuildCreateDropsReplacedChannelMessages(t *testing.T) {
+	c := newTestCache(CacheConfig{MessageMaxItems: 10})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","channels":[{"id":"11"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	createMessage(t, c, 11, 100)
+	if _, err := c.GuildCreate([]byte(`{"id":"10","channels":[{"id":"12"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ := c.GetMessage(11, 100); msg != nil {
+		t.Errorf("expected the message from the replaced channel to be gone, got %v", msg)
+	}
+	if _, ok := c.ChannelMessageRelationship[11]; ok {
+		t.Error("expected the message relationship of the replaced channel to be gone")
+	}
+	if c.Messages.Len() != 0 {
+		t.Errorf("expected the message store to be empty, got %d messages", c.Messages.Len())
+	}
+}
+
+// Defines a metrics hook which panics on stores of one cache type whilst armed.
+type panickingMetricsHook struct {
+	cacheType string
+	armed     bool
+}
+
+func (h *panickingMetricsHook) ObserveGet(string, bool) {}
+
+func (h *panickingMetricsHook) ObserveSet(cacheType string) {
+	if h.armed && cacheType == h.cacheType {
+		panic("disgordtlru: test panic")
+	}
+}
+
+func TestRecoveredPanicsReleaseLocks(t *testing.T) {
+	for name, handle := range map[string]func(c *cache) error{
+		"GuildMemberAdd": func(c *cache) error {
+			_, err := c.GuildMemberAdd([]byte(`{"guild_id":"10","user":{"id":"20"}}`))
+			return err
+		},
+		"GuildMembersChunk": func(c *cache) error {
+			_, err := c.GuildMembersChunk([]byte(`{"guild_id":"10","members":[{"user":{"id":"20"}}]}`))
+			return err
+		},
+	} {
+		hook := &panickingMetricsHook{cacheType: storeUser}
+		c := newTestCache(CacheConfig{RecoverHandlers: true, MetricsHook: hook})
+		if _, err := c.GuildCreate([]byte(`{"id":"10"}`)); err != nil {
+			t.Fatal(err)
+		}
+		hook.armed = true
+		if err := handle(c); err == nil {
+			t.Errorf("%s: expected the panic to be turned into an error", name)
+		}
+		hook.armed = false
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handle(c)
+			c.GetUser(20)
+			c.GetMember(10, 20)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the locks were left held after recovering from the panic", name)
+		}
+	}
+}
+
+func TestGuildMembersChunkKeepsMemberCountConsistent(t *testing.T) {
+	// Without a logger, an inconsistency panics.
+	c := newTestCache(CacheConfig{DebugConsistencyChecks: true})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","members":[{"user":{"id":"20"}}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GuildMembersChunk([]byte(`{"guild_id":"10","members":[{"user":{"id":"21"}},{"user":{"id":"22"}}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if errs := c.validateGuild(10); len(errs) != 0 {
+		t.Errorf("expected the guild to be consistent, got %v", errs)
+	}
+	if guild, _ := c.GetGuild(10); guild.MemberCount != 3 {
+		t.Errorf("expected the member count to be raised to the 3 loaded members, got %d", guild.MemberCount)
+	}
+}
+
+func TestEnumerationsSortedByID(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	for _, data := range []string{
+		`{"id":"12","features":["NEWS"],"channels":[{"id":"22"},{"id":"20"}]}`,
+		`{"id":"10","features":["NEWS"],"channels":[{"id":"21"}]}`,
+		`{"id":"11","channels":[{"id":"23"}]}`,
+	} {
+		if _, err := c.GuildCreate([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	guildIds := func(guilds []*disgord.Guild) []disgord.Snowflake {
+		var ids []disgord.Snowflake
+		for _, guild := range guilds {
+			ids = append(ids, guild.ID)
+		}
+		return ids
+	}
+	for i := 0; i < 3; i++ {
+		guilds, _ := c.GetAllGuilds()
+		if ids := guildIds(guilds); !reflect.DeepEqual(ids, []disgord.Snowflake{10, 11, 12}) {
+			t.Errorf("expected the guilds sorted by ID, got %v", ids)
+		}
+		guilds, _ = c.GetGuildsByFeature("NEWS")
+		if ids := guildIds(guilds); !reflect.DeepEqual(ids, []disgord.Snowflake{10, 12}) {
+			t.Errorf("expected the guilds with the feature sorted by ID, got %v", ids)
+		}
+		channels, _ := c.GetAllChannels()
+		var ids []disgord.Snowflake
+		for _, channel := range channels {
+			ids = append(ids, channel.ID)
+		}
+		if !reflect.DeepEqual(ids, []disgord.Snowflake{20, 21, 22, 23}) {
+			t.Errorf("expected the channels sorted by ID, got %v", ids)
+		}
+	}
+}
+
+func TestSetChannels(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	channelIds := func(guildID disgord.Snowflake) []disgord.Snowflake {
+		channels, err := c.GetGuildChannels(guildID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []disgord.Snowflake
+		for _, channel := range channels {
+			ids = append(ids, channel.ID)
+		}
+		return ids
+	}
+
+	seed := []*disgord.Channel{{ID: 11, Name: "a"}, {ID: 12, Name: "b"}}
+	c.SetChannels(10, seed)
+	seed[0].Name = "changed"
+	if ids := channelIds(10); !reflect.DeepEqual(ids, []disgord.Snowflake{11, 12}) {
+		t.Fatalf("expected channels 11 and 12, got %v", ids)
+	}
+	if channel, _ := c.GetChannel(11); channel == nil || channel.Name != "a" || channel.GuildID != 10 {
+		t.Errorf("expected a copy of channel 11 under guild 10, got %v", channel)
+	}
+
+	// Seeding again replaces the relationship, so 11 is dropped and 12 is only registered once.
+	c.SetChannels(10, []*disgord.Channel{{ID: 12, Name: "c"}, {ID: 13}, nil})
+	if ids := channelIds(10); !reflect.DeepEqual(ids, []disgord.Snowflake{12, 13}) {
+		t.Errorf("expected channels 12 and 13, got %v", ids)
+	}
+	if channel, _ := c.GetChannel(11); channel != nil {
+		t.Errorf("expected the replaced channel to be dropped, got %v", channel)
+	}
+	if channel, _ := c.GetChannel(12); channel == nil || channel.Name != "c" {
+		t.Errorf("expected channel 12 to be replaced, got %v", channel)
+	}
+	if errs := c.ValidateRelationships(); len(errs) != 0 {
+		t.Errorf("expected the relationships to be valid, got %v", errs)
+	}
+
+	c.SetChannels(10, nil)
+	if ids := channelIds(10); len(ids) != 0 {
+		t.Errorf("expected no channels, got %v", ids)
+	}
+}
+
+func TestGetGuildChannelTree(t *testing.T) {
+	c := newTestCache(CacheConfig{})
+	if _, err := c.GuildCreate([]byte(`{"id":"10","channels":[
+		{"id":"20","type":4,"position":1},
+		{"id":"21","type":4,"position":0},
+		{"id":"30","type":0,"parent_id":"20","position":2},
+		{"id":"31","type":0,"parent_id":"20","position":1},
+		{"id":"32","type":2,"parent_id":"21","position":0},
+		{"id":"33","type":0,"position":1},
+		{"id":"34","type":0,"parent_id":"99","position":0}
+	]}`)); err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := c.GetGuildChannelTree(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type node struct {
+		category disgord.Snowflake
+		children []disgord.Snowflake
+	}
+	var got []node
+	for _, n := range nodes {
+		var g node
+		if n.Channel != nil {
+			g.category = n.Channel.ID
+		}
+		for _, child := range n.Children {
+			g.children = append(g.children, child.ID)
+		}
+		got = append(got, g)
+	}
+	// Loose channels come first, including ones whose category is not cached, and then the categories by position.
+	expected := []node{
+		{0, []disgord.Snowflake{34, 33}},
+		{21, []disgord.Snowflake{32}},
+		{20, []disgord.Snowflake{31, 30}},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the tree %v, got %v", expected, got)
+	}
+	if nodes, _ := c.GetGuildChannelTree(11); nodes != nil {
+		t.Errorf("expected no tree for an uncached guild, got %v", nodes)
+	}
+}
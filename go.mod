@@ -2,7 +2,4 @@ module github.com/auttaja/disgord-tlru
 
 go 1.14
 
-require (
-	github.com/andersfylling/disgord v0.18.1-0.20200823151040-03e4662b35a3
-	github.com/auttaja/go-tlru v0.0.0-20200823214418-2a1d18ce6d93
-)
+require github.com/andersfylling/disgord v0.18.1-0.20200823151040-03e4662b35a3
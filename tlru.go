@@ -0,0 +1,222 @@
+package disgordtlru
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Defines an item in the TLRU.
+type tlruItem struct {
+	key     interface{}
+	value   interface{}
+	size    int
+	expires time.Time
+}
+
+// Defines a time aware least recently used cache. This is based on go-tlru, but it can be looked into without reviving items,
+// enumerated, and reports the items it evicts.
+// Every item lives for the same duration from when it was last set or got, so the least recently used items are also the first
+// to expire. Expired items are treated as missing straight away and removed the next time an item is set.
+type tlruCache struct {
+	m          sync.Mutex
+	keyList    *list.List
+	valueMap   map[interface{}]*list.Element
+	maxLen     int
+	maxBytes   int
+	totalBytes int
+	duration   time.Duration
+	now        func() time.Time
+
+	// onEvict is called with every item which is removed because it expired or the cache was full. This can be nil.
+	// It is called by Set once the TLRU's own mutex is released, so it runs under whatever lock the caller of Set holds.
+	// Items removed with Delete or Erase are not reported.
+	onEvict func(key, value interface{})
+}
+
+// Used to create a TLRU. Setting maxLen or maxBytes to 0 means unlimited.
+func newTLRU(maxLen, maxBytes int, duration time.Duration, now func() time.Time) *tlruCache {
+	return &tlruCache{
+		keyList:  list.New(),
+		valueMap: map[interface{}]*list.Element{},
+		maxLen:   maxLen,
+		maxBytes: maxBytes,
+		duration: duration,
+		now:      now,
+	}
+}
+
+// Used to remove an item from the TLRU.
+// THIS FUNCTION EXPECTS THE TLRU MUTEX TO BE HELD!
+func (c *tlruCache) remove(el *list.Element) *tlruItem {
+	item := c.keyList.Remove(el).(*tlruItem)
+	delete(c.valueMap, item.key)
+	c.totalBytes -= item.size
+	return item
+}
+
+// Used to find an item which has not expired.
+// THIS FUNCTION EXPECTS THE TLRU MUTEX TO BE HELD!
+func (c *tlruCache) find(key interface{}, now time.Time) (*list.Element, bool) {
+	el, ok := c.valueMap[key]
+	if !ok || !now.Before(el.Value.(*tlruItem).expires) {
+		return nil, false
+	}
+	return el, true
+}
+
+// Get is used to try and get an item from the TLRU. This revives the item, pushing back when it expires.
+func (c *tlruCache) Get(key interface{}) (interface{}, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	now := c.now()
+	el, ok := c.find(key, now)
+	if !ok {
+		return nil, false
+	}
+	c.keyList.MoveToBack(el)
+	item := el.Value.(*tlruItem)
+	item.expires = now.Add(c.duration)
+	return item.value, true
+}
+
+// Peek is used to try and get an item from the TLRU without reviving it.
+func (c *tlruCache) Peek(key interface{}) (interface{}, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	el, ok := c.find(key, c.now())
+	if !ok {
+		return nil, false
+	}
+	return el.Value.(*tlruItem).value, true
+}
+
+// Expires is used to get when an item will expire if it is not revived before then.
+func (c *tlruCache) Expires(key interface{}) (time.Time, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	el, ok := c.find(key, c.now())
+	if !ok {
+		return time.Time{}, false
+	}
+	return el.Value.(*tlruItem).expires, true
+}
+
+// Set is used to set an item in the TLRU, reviving it if it already exists.
+// Items which are bigger than the max bytes on their own are not cached.
+func (c *tlruCache) Set(key, value interface{}) {
+	c.m.Lock()
+	now := c.now()
+	var evicted []*tlruItem
+
+	// Expired items are always at the front since every item lives for the same duration.
+	for el := c.keyList.Front(); el != nil && !now.Before(el.Value.(*tlruItem).expires); el = c.keyList.Front() {
+		evicted = append(evicted, c.remove(el))
+	}
+
+	size := 0
+	if c.maxBytes != 0 {
+		size = int(sizeof(value))
+	}
+	el, exists := c.valueMap[key]
+	if c.maxBytes != 0 && size > c.maxBytes {
+		// Don't cache this, and don't keep the old value around either since it is out of date.
+		if exists {
+			evicted = append(evicted, c.remove(el))
+		}
+	} else {
+		if exists {
+			item := el.Value.(*tlruItem)
+			c.totalBytes += size - item.size
+			item.value = value
+			item.size = size
+			item.expires = now.Add(c.duration)
+			c.keyList.MoveToBack(el)
+		} else {
+			if c.maxLen != 0 && len(c.valueMap) >= c.maxLen {
+				evicted = append(evicted, c.remove(c.keyList.Front()))
+			}
+			c.valueMap[key] = c.keyList.PushBack(&tlruItem{key: key, value: value, size: size, expires: now.Add(c.duration)})
+			c.totalBytes += size
+		}
+
+		// The item we just set is at the back and fits on its own, so this stops before reaching it.
+		for c.maxBytes != 0 && c.totalBytes > c.maxBytes {
+			evicted = append(evicted, c.remove(c.keyList.Front()))
+		}
+	}
+	c.m.Unlock()
+
+	if c.onEvict != nil {
+		for _, item := range evicted {
+			c.onEvict(item.key, item.value)
+		}
+	}
+}
+
+// Delete is used to delete an item from the TLRU. Nothing happens if the item is not cached.
+func (c *tlruCache) Delete(key interface{}) {
+	c.m.Lock()
+	if el, ok := c.valueMap[key]; ok {
+		c.remove(el)
+	}
+	c.m.Unlock()
+}
+
+// Erase is used to remove every item from the TLRU.
+func (c *tlruCache) Erase() {
+	c.m.Lock()
+	c.keyList = list.New()
+	c.valueMap = map[interface{}]*list.Element{}
+	c.totalBytes = 0
+	c.m.Unlock()
+}
+
+// Used to count the expired items at the front of the TLRU.
+// THIS FUNCTION EXPECTS THE TLRU MUTEX TO BE HELD!
+func (c *tlruCache) expired(now time.Time) int {
+	n := 0
+	for el := c.keyList.Front(); el != nil && !now.Before(el.Value.(*tlruItem).expires); el = el.Next() {
+		n++
+	}
+	return n
+}
+
+// Len is used to get the amount of items in the TLRU which have not expired.
+func (c *tlruCache) Len() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return len(c.valueMap) - c.expired(c.now())
+}
+
+// Keys is used to get the keys of the items in the TLRU which have not expired, least recently used first.
+// This does not revive the items.
+func (c *tlruCache) Keys() []interface{} {
+	c.m.Lock()
+	defer c.m.Unlock()
+	now := c.now()
+	keys := make([]interface{}, 0, len(c.valueMap))
+	for el := c.keyList.Front(); el != nil; el = el.Next() {
+		if item := el.Value.(*tlruItem); now.Before(item.expires) {
+			keys = append(keys, item.key)
+		}
+	}
+	return keys
+}
+
+// Used to check that the list and map of the TLRU agree and that it is within its limits. This is constant time.
+func (c *tlruCache) check() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.keyList == nil || c.valueMap == nil {
+		return errors.New("disgordtlru: a TLRU is missing its list or map")
+	}
+	if c.keyList.Len() != len(c.valueMap) {
+		return errors.New("disgordtlru: a TLRU list and map have different lengths")
+	}
+	if (c.maxLen != 0 && len(c.valueMap) > c.maxLen) || (c.maxBytes != 0 && c.totalBytes > c.maxBytes) || c.totalBytes < 0 {
+		return errors.New("disgordtlru: a TLRU is over its limits")
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package disgordtlru
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTLRUPeekDoesNotRevive(t *testing.T) {
+	clock := &testClock{t: time.Unix(1600000000, 0)}
+	c := newTLRU(0, 0, time.Minute, clock.now)
+	c.Set(1, "a")
+	c.Set(2, "b")
+
+	clock.advance(40 * time.Second)
+	if _, ok := c.Peek(1); !ok {
+		t.Fatal("expected 1 to be cached")
+	}
+	if _, ok := c.Get(2); !ok {
+		t.Fatal("expected 2 to be cached")
+	}
+
+	clock.advance(40 * time.Second)
+	if _, ok := c.Peek(1); ok {
+		t.Error("expected 1 to have expired since peeking does not revive")
+	}
+	if _, ok := c.Peek(2); !ok {
+		t.Error("expected 2 to still be cached since getting revives")
+	}
+	if c.Len() != 1 {
+		t.Errorf("expected a length of 1, got %d", c.Len())
+	}
+	if keys := c.Keys(); len(keys) != 1 || keys[0] != 2 {
+		t.Errorf("expected the keys to be [2], got %v", keys)
+	}
+}
+
+func TestTLRUEvictions(t *testing.T) {
+	clock := &testClock{t: time.Unix(1600000000, 0)}
+	c := newTLRU(2, 0, time.Minute, clock.now)
+	var evicted []interface{}
+	c.onEvict = func(key, _ interface{}) {
+		evicted = append(evicted, key)
+	}
+
+	c.Set(1, "a")
+	c.Set(2, "b")
+	c.Set(3, "c")
+	if len(evicted) != 1 || evicted[0] != 1 {
+		t.Fatalf("expected 1 to be evicted for space, got %v", evicted)
+	}
+
+	clock.advance(time.Minute)
+	c.Set(4, "d")
+	if len(evicted) != 3 || evicted[1] != 2 || evicted[2] != 3 {
+		t.Fatalf("expected 2 and 3 to be evicted for expiring, got %v", evicted)
+	}
+
+	// Deletes are made by the caller, so they are not reported.
+	c.Delete(4)
+	c.Delete(5)
+	if len(evicted) != 3 || c.Len() != 0 {
+		t.Errorf("expected the delete to go unreported and empty the TLRU, got %v with a length of %d", evicted, c.Len())
+	}
+	if err := c.check(); err != nil {
+		t.Error(err)
+	}
+}